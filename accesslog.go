@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"time"
+)
+
+/* access log entries go here, the diagnostic log unless --access-log is set */
+var accessLog = log.StandardLogger()
+
+// send access entries to a rotated json file, see --access-log
+func openAccessLog(path string, maxSize int64, interval time.Duration, maxBackups int) error {
+	file, err := openRotatingFile(path, maxSize, interval, maxBackups)
+	if err != nil {
+		return fmt.Errorf("access log: %s", err)
+	}
+	accessLog = &log.Logger{Out: file, Formatter: &log.JSONFormatter{}, Hooks: make(log.LevelHooks), Level: log.InfoLevel}
+	return nil
+}
+
+// access entries on the diagnostic log output at their own level, so --quiet
+// keeps the line per request while silencing info logs
+func stderrAccessLog() *log.Logger {
+	std := log.StandardLogger()
+	return &log.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: make(log.LevelHooks), Level: log.InfoLevel}
+}
+
+// write one structured access log entry for a scanned request
+func logRequest(ctx *fasthttp.RequestCtx, status int, scanTime time.Duration, matchResps []MatchResp) {
+	ids := []int{}
+	seen := make(map[int]bool)
+	for _, m := range matchResps {
+		if !seen[m.Id] {
+			seen[m.Id] = true
+			ids = append(ids, m.Id)
+		}
+	}
+
+	accessLog.WithFields(log.Fields{
+		"ip":         clientIP(ctx).String(),
+		"method":     string(ctx.Method()),
+		"path":       string(ctx.Path()),
+		"request_id": requestID(ctx),
+		"scan_us":    scanTime.Nanoseconds() / 1000,
+		"matches":    len(matchResps),
+		"rules":      ids,
+		"status":     status,
+	}).Info("access")
+}
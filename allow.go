@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/valyala/fasthttp" /* http parse lib */
+	"net"
+	"strings"
+)
+
+var (
+	/* clients and paths never scanned, see --allow-ips and --allow-paths */
+	AllowNets  []*net.IPNet
+	AllowPaths [][]byte
+
+	/* peers whose forwarding headers are believed, see clientIP */
+	TrustedProxies []*net.IPNet
+)
+
+// parse --allow-ips, a plain ip is a single address network
+func parseAllowIPs(list []string) ([]*net.IPNet, error) {
+	return parseIPNets("allow ip", list)
+}
+
+// parse a list of CIDRs and plain ips, what names the flag in errors
+func parseIPNets(what string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s: %s", what, s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", what, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// request is from an allowed client or for an allowed path
+func isAllowed(ctx *fasthttp.RequestCtx) bool {
+	path := ctx.Path()
+	for _, prefix := range AllowPaths {
+		if bytes.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return len(AllowNets) > 0 && containsIP(AllowNets, clientIP(ctx))
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the real client of the request. Behind a --trusted-proxies peer it is the last
+// X-Forwarded-For hop not itself a trusted proxy, or X-Real-IP. Otherwise, and
+// always without trusted proxies, forwarding headers can be spoofed and the
+// direct peer is used.
+func clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	peer := ctx.RemoteIP()
+	if len(TrustedProxies) == 0 || !containsIP(TrustedProxies, peer) {
+		return peer
+	}
+	if xff := ctx.Request.Header.Peek("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(string(xff), ",")
+		var ip net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				/* garbage in the chain, don't trust anything before it */
+				break
+			}
+			ip = hop
+			if !containsIP(TrustedProxies, hop) {
+				return hop
+			}
+		}
+		if ip != nil {
+			return ip
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(string(ctx.Request.Header.Peek("X-Real-IP")))); ip != nil {
+		return ip
+	}
+	return peer
+}
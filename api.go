@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* POST /scan request */
+type ScanRequest struct {
+	Data    *string `json:"data"`
+	Context string  `json:"context"`
+}
+
+/* POST /scan/bulk result line */
+type BulkResp struct {
+	Line int `json:"line"` /* 1-based input line number */
+	Response
+}
+
+/* GET /info */
+type InfoResp struct {
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    float64   `json:"uptime_seconds"`
+	Rules     int       `json:"rules"`
+	Files     []string  `json:"files"`
+	Flag      string    `json:"flag"`
+	Mode      string    `json:"mode"`
+	BuiltAt   time.Time `json:"built_at"`
+	BuildTime float64   `json:"build_seconds"` /* of the last (re)load */
+
+	DbSize      int `json:"db_bytes"`
+	ScratchSize int `json:"scratch_bytes"` /* of one scratch */
+	Scratches   int `json:"scratch_pool_size"`
+	StreamSize  int `json:"stream_bytes,omitempty"` /* of one open stream in stream mode */
+}
+
+/* scan result with --response=minimal */
+type MinimalResp struct {
+	Block bool `json:"block"`
+	Rule  int  `json:"rule,omitempty"` /* first rule asking to block */
+}
+
+/* GET /version */
+type VersionResp struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+/* GET /rules/warnings item */
+type RuleWarningsResp struct {
+	Id       int      `json:"id"`
+	Expr     string   `json:"expr"`
+	Warnings []string `json:"warnings"`
+}
+
+/* GET /rules item */
+type RuleResp struct {
+	Id int `json:"id"`
+	RegexLine
+	Disabled bool `json:"disabled"`
+}
+
+// adminOnly guards h with --admin-token, without a token only loopback clients are allowed
+func adminOnly(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if AdminToken == "" {
+			if !ctx.RemoteIP().IsLoopback() {
+				writeJSON(ctx, fasthttp.StatusForbidden, Response{Errno: -1, Msg: "admin api is only allowed from localhost without --admin-token"})
+				return
+			}
+		} else {
+			auth := string(ctx.Request.Header.Peek("Authorization"))
+			/* the Bearer scheme is required, a bare token is refused */
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(AdminToken)) != 1 {
+				writeJSON(ctx, fasthttp.StatusForbidden, Response{Errno: -1, Msg: "invalid admin token"})
+				return
+			}
+		}
+		h(ctx)
+	}
+}
+
+// methods answers 405 with an Allow header unless the request uses one of allowed
+func methods(h fasthttp.RequestHandler, allowed ...string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		method := string(ctx.Method())
+		for _, m := range allowed {
+			if method == m {
+				h(ctx)
+				return
+			}
+		}
+		methodNotAllowed(ctx, allowed...)
+	}
+}
+
+func methodNotAllowed(ctx *fasthttp.RequestCtx, allowed ...string) {
+	ctx.Response.Header.Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(ctx, fasthttp.StatusMethodNotAllowed, Response{Errno: -1, Msg: "method not allowed"})
+}
+
+// write resp as json body with status code, every json response of the
+// server goes through here so they share the Response shape and content type
+func writeJSON(ctx *fasthttp.RequestCtx, status int, resp Response) {
+	resp.RequestID = requestID(ctx)
+	writeEncoded(ctx, status, resp)
+}
+
+// write v as json body with status code, for bodies other than Response
+func writeEncoded(ctx *fasthttp.RequestCtx, status int, v interface{}) {
+	ctx.Response.Header.Set("X-Request-ID", requestID(ctx))
+	/* encode first, so status and length always describe the body sent */
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Error(fmt.Sprintf("encode response: %s", err))
+		status = fasthttp.StatusInternalServerError
+		body = []byte(`{"errno":-2,"msg":"encode response error"}`)
+	}
+	ctx.Response.Header.Set("Content-Type", responseContentType())
+	ctx.Response.SetBody(body)
+	ctx.Response.Header.SetContentLength(len(body))
+	ctx.Response.SetStatusCode(status)
+}
+
+func responseContentType() string {
+	if ContentType == "" {
+		return "application/json"
+	}
+	return ContentType
+}
+
+// POST /scan, scan arbitrary text given as {"data": "...", "context": "..."}
+func scanHandler(ctx *fasthttp.RequestCtx) {
+	var req ScanRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: fmt.Sprintf("invalid json: %s", err)})
+		return
+	}
+	if req.Data == nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: "missing field: data"})
+		return
+	}
+
+	matchResps, err := scanRequestPart(scanPart{target: "data", data: []byte(*req.Data), categories: queryCategories(ctx)})
+	truncated := err == errMaxMatches
+	if truncated {
+		err = nil
+	}
+	if _, ok := err.(*invalidUTF8Error); ok {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: err.Error()})
+		return
+	}
+	if err == errScanTimeout {
+		writeJSON(ctx, fasthttp.StatusServiceUnavailable, Response{Errno: -6, Msg: fmt.Sprintf("scan exceeded %s, partial results", ScanTimeout), Data: matchResps})
+		return
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, Response{Errno: -2, Msg: fmt.Sprintf("Db.Scan error: %s", err)})
+		return
+	}
+	/* caller supplied context replaces the scanned data in results */
+	if req.Context != "" {
+		for i := range matchResps {
+			matchResps[i].Context = req.Context
+		}
+	}
+
+	resp := Response{Errno: 0, Data: matchResps, MatchesTruncated: truncated}
+	if len(matchResps) <= 0 {
+		resp.Errno = 1
+		resp.Msg = "no match"
+	}
+	writeJSON(ctx, fasthttp.StatusOK, resp)
+}
+
+// POST /scan/bulk, scan every line of the body as its own input and
+// stream one json result per line back as it is scanned
+func bulkScanHandler(ctx *fasthttp.RequestCtx) {
+	/* the stream writer runs after the handler returns, keep our own copy */
+	body := append([]byte(nil), ctx.PostBody()...)
+	categories := queryCategories(ctx)
+	ctx.Response.Header.Set("Content-Type", "application/x-ndjson")
+	ctx.Response.Header.Set("X-Request-ID", requestID(ctx))
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc := json.NewEncoder(w)
+		for n := 1; len(body) > 0; n++ {
+			line := body
+			if i := bytes.IndexByte(body, '\n'); i >= 0 {
+				line, body = body[:i], body[i+1:]
+			} else {
+				body = nil
+			}
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) == 0 {
+				continue
+			}
+			resp := BulkResp{Line: n}
+			/* the response is already streaming, wait for a slot per line instead of 503 */
+			if scanSlots != nil {
+				scanSlots <- struct{}{}
+			}
+			matchResps, err := scanRequestPart(scanPart{target: "data", data: line, categories: categories})
+			if scanSlots != nil {
+				<-scanSlots
+			}
+			if err == errMaxMatches {
+				resp.MatchesTruncated, err = true, nil
+			}
+			switch {
+			case err != nil:
+				resp.Errno = -2
+				resp.Msg = err.Error()
+			case len(matchResps) == 0:
+				resp.Errno = 1
+				resp.Msg = "no match"
+			default:
+				resp.Data = matchResps
+			}
+			if err := enc.Encode(resp); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				/* client went away */
+				return
+			}
+		}
+	})
+}
+
+// GET /info, what the running rules were built from
+func infoHandler(ctx *fasthttp.RequestCtx) {
+	e := currentEngine()
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: InfoResp{
+		Version:   Version,
+		StartedAt: Uptime,
+		Uptime:    time.Since(Uptime).Seconds(),
+		Rules:     len(e.regexMap),
+		Files:     e.filepaths,
+		Flag:      e.flag,
+		Mode:      e.mode,
+		BuiltAt:   e.builtAt,
+		BuildTime: e.buildTime.Seconds(),
+
+		DbSize:      e.dbSize,
+		ScratchSize: e.scratchSize,
+		Scratches:   PoolSize,
+		StreamSize:  e.streamSize,
+	}})
+}
+
+// GET /version, which binary is running
+func versionHandler(ctx *fasthttp.RequestCtx) {
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: VersionResp{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}})
+}
+
+// GET /rules, list all loaded rules ordered by id
+func rulesHandler(ctx *fasthttp.RequestCtx) {
+	regexMap := currentEngine().regexMap
+	rules := make([]RuleResp, 0, len(regexMap))
+	for id, regexLine := range regexMap {
+		rules = append(rules, RuleResp{id, regexLine, disabledRules.Has(id)})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Id < rules[j].Id })
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: rules})
+}
+
+// GET /rules/warnings, load time diagnostics of the loaded rules ordered by id,
+// rules without any are left out
+func ruleWarningsHandler(ctx *fasthttp.RequestCtx) {
+	warnings := []RuleWarningsResp{}
+	for id, regexLine := range currentEngine().regexMap {
+		if len(regexLine.Warnings) > 0 {
+			warnings = append(warnings, RuleWarningsResp{id, regexLine.Expr, regexLine.Warnings})
+		}
+	}
+	sort.Slice(warnings, func(i, j int) bool { return warnings[i].Id < warnings[j].Id })
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: warnings})
+}
+
+// GET /rules/{id}, POST /rules/{id}/disable and POST /rules/{id}/enable
+func ruleHandler(ctx *fasthttp.RequestCtx) {
+	path := strings.TrimPrefix(string(ctx.Path()), "/rules/")
+	action := ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path, action = path[:i], path[i+1:]
+	}
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: "invalid rule id"})
+		return
+	}
+	if action == "disable" || action == "enable" {
+		ruleStateHandler(ctx, id, action == "disable")
+		return
+	}
+	if action != "" {
+		writeJSON(ctx, fasthttp.StatusNotFound, Response{Errno: -1, Msg: fmt.Sprintf("unknown rule action: %s", action)})
+		return
+	}
+	if !ctx.IsGet() && !ctx.IsHead() {
+		methodNotAllowed(ctx, "GET", "HEAD")
+		return
+	}
+	regexLine, ok := currentEngine().regexMap[id]
+	if !ok {
+		writeJSON(ctx, fasthttp.StatusNotFound, Response{Errno: 1, Msg: fmt.Sprintf("rule %d not found", id)})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: RuleResp{id, regexLine, disabledRules.Has(id)}})
+}
+
+// disable or enable rule id, a rule no longer loaded can still be enabled to drop it from the set
+func ruleStateHandler(ctx *fasthttp.RequestCtx, id int, disable bool) {
+	if !ctx.IsPost() {
+		methodNotAllowed(ctx, "POST")
+		return
+	}
+	regexLine, ok := currentEngine().regexMap[id]
+	if !ok && disable {
+		writeJSON(ctx, fasthttp.StatusNotFound, Response{Errno: 1, Msg: fmt.Sprintf("rule %d not found", id)})
+		return
+	}
+	if err := disabledRules.Set(id, disable); err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, Response{Errno: -2, Msg: fmt.Sprintf("save disabled rules: %s", err)})
+		return
+	}
+	log.Info(fmt.Sprintf("rule %d disabled: %v", id, disable))
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: RuleResp{id, regexLine, disable}})
+}
+
+// POST /reload, rebuild rules from --filepath
+func reloadHandler(ctx *fasthttp.RequestCtx) {
+	n, err := tryReloadRules()
+	if err == errReloadInProgress {
+		writeJSON(ctx, fasthttp.StatusConflict, Response{Errno: -5, Msg: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, Response{Errno: -2, Msg: fmt.Sprintf("reload error: %s", err)})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: map[string]int{"rules": n}})
+}
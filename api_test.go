@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// send body to h as a POST request
+func doRequest(h fasthttp.RequestHandler, uri string, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.SetBodyString(body)
+	h(ctx)
+	return ctx
+}
+
+func TestScanHandler(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := doRequest(scanHandler, "/scan", `{"data": "<script>alert(1)</script>", "context": "line 1"}`)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("expect 200, got %d", code)
+	}
+	if n := ctx.Response.Header.ContentLength(); n != len(ctx.Response.Body()) {
+		t.Errorf("expect Content-Length %d, got %d", len(ctx.Response.Body()), n)
+	}
+	var resp struct {
+		Errno int
+		Data  []MatchResp
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Id != 101 || resp.Data[0].Context != "line 1" {
+		t.Errorf("unexpected matches: %+v", resp.Data)
+	}
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"errno":0`) || !strings.Contains(body, `"regexline":{"expr":`) || strings.Contains(body, `"msg"`) {
+		t.Errorf("unexpected json keys: %s", body)
+	}
+
+	ctx = doRequest(scanHandler, "/scan?categories=sqli", `{"data": "<script>alert(1)</script>"}`)
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"errno":1`) {
+		t.Errorf("expect xss match filtered out by categories, got %s", body)
+	}
+	ctx = doRequest(scanHandler, "/scan?categories=SQLi,xss", `{"data": "<script>alert(1)</script>"}`)
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"category":"xss"`) {
+		t.Errorf("expect xss match kept by categories, got %s", body)
+	}
+
+	/* the scan and bench commands scan their input the same way */
+	ctx = doRequest(scanHandler, "/scan", `{"data": ""}`)
+	if body := string(ctx.Response.Body()); ctx.Response.StatusCode() != fasthttp.StatusOK || !strings.Contains(body, `"errno":1`) {
+		t.Errorf("expect no match for empty data, got %d: %s", ctx.Response.StatusCode(), body)
+	}
+
+	for _, body := range []string{`{"data":`, `{}`, `[1]`} {
+		ctx = doRequest(scanHandler, "/scan", body)
+		if code := ctx.Response.StatusCode(); code != fasthttp.StatusBadRequest {
+			t.Errorf("expect 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestRulesAdminToken(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	AdminToken = "secret"
+	defer func() { AdminToken = "" }()
+
+	ctx := doRequest(adminOnly(ruleHandler), "/rules/101", "")
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusForbidden {
+		t.Errorf("expect 403 without token, got %d", code)
+	}
+	for _, auth := range []string{"secret", "Basic secret", "Bearer secrets"} {
+		ctx = &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/rules/101")
+		ctx.Request.Header.Set("Authorization", auth)
+		adminOnly(ruleHandler)(ctx)
+		if code := ctx.Response.StatusCode(); code != fasthttp.StatusForbidden {
+			t.Errorf("expect 403 for Authorization %q, got %d", auth, code)
+		}
+	}
+
+	for uri, expect := range map[string]int{"/rules/101": 200, "/rules/999": 404, "/rules/x": 400} {
+		ctx = &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.Set("Authorization", "Bearer secret")
+		adminOnly(ruleHandler)(ctx)
+		if code := ctx.Response.StatusCode(); code != expect {
+			t.Errorf("expect %d for %s, got %d", expect, uri, code)
+		}
+	}
+}
+
+func TestHeaderParts(t *testing.T) {
+	var header fasthttp.RequestHeader
+	header.Set("User-Agent", "sqlmap/1.0")
+	header.Set("Referer", "http://example.com/")
+	header.Set("Cookie", "a=b")
+
+	HeaderExclude = headerSet([]string{"cookie"})
+	defer func() { HeaderExclude = nil }()
+	contexts := make(map[string]bool)
+	for _, part := range headerParts(&header) {
+		contexts[part.label+string(part.data)] = true
+	}
+	if !contexts["User-Agent: sqlmap/1.0"] || !contexts["Referer: http://example.com/"] {
+		t.Errorf("missing header parts: %v", contexts)
+	}
+	if contexts["Cookie: a=b"] {
+		t.Error("excluded cookie header scanned")
+	}
+}
+
+// test an empty header value is not scanned, hyperscan refuses empty input
+func TestEmptyHeader(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetHeaders: true}
+	defer func() { ScanTargets = nil }()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/")
+	ctx.Request.Header.Set("X-Foo", "")
+	ctx.Request.Header.Set("User-Agent", "curl")
+	for _, part := range headerParts(&ctx.Request.Header) {
+		if len(part.data) == 0 {
+			t.Errorf("empty header part %+v", part)
+		}
+	}
+	requestHandler(ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("expect 200 with an empty header, got %d: %s", code, ctx.Response.Body())
+	}
+}
+
+// test --scan-cookies scans each cookie instead of the Cookie header
+func TestCookieParts(t *testing.T) {
+	ScanTargets = map[string]bool{TargetHeaders: true, TargetCookies: true}
+	defer func() { ScanTargets = nil }()
+	var header fasthttp.RequestHeader
+	header.Set("Cookie", "session=abc; theme=<script>")
+	header.Set("User-Agent", "curl")
+
+	contexts := make(map[string]bool)
+	for _, part := range append(headerParts(&header), cookieParts(&header)...) {
+		contexts[part.target+" "+part.label+string(part.data)] = true
+	}
+	if !contexts["cookies session=abc"] || !contexts["cookies theme=<script>"] || !contexts["headers User-Agent: curl"] {
+		t.Errorf("missing cookie parts: %v", contexts)
+	}
+	if len(contexts) != 3 {
+		t.Errorf("expect the Cookie header not scanned as a whole: %v", contexts)
+	}
+}
+
+// test the request line is scanned by component
+func TestRequestLineParts(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("PROPFIND")
+	ctx.Request.SetRequestURI("/a?b=1")
+	parts := requestLineParts(ctx)
+	var got []string
+	for _, part := range parts {
+		got = append(got, part.label+string(part.data))
+	}
+	if strings.Join(got, "|") != "method: PROPFIND|protocol: HTTP/1.1|line: PROPFIND /a?b=1 HTTP/1.1" {
+		t.Errorf("unexpected request line parts: %q", got)
+	}
+}
+
+// test --scan-args reports the arg carrying the match
+func TestArgParts(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetURI: true}
+	ScanArgs = true
+	defer func() { ScanTargets, ScanArgs = nil, false }()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/search?page=1&q=%3Cscript%3Ealert(1)")
+	if parts := argParts(ctx); len(parts) != 3 || string(parts[0].data) != "/search" || parts[2].label != "q=" {
+		t.Errorf("unexpected arg parts: %+v", parts)
+	}
+	requestHandler(ctx)
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"context":"q=","regexline"`) {
+		t.Errorf("expect match context labelled with the arg name, got %s", body)
+	}
+}
+
+// test --scan-multipart scans each form field and the head of uploads
+func TestMultipartParts(t *testing.T) {
+	ScanMultipart, MultipartFileBytes = true, 8
+	defer func() { ScanMultipart, MultipartFileBytes = false, 0 }()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("name", "bob")
+	w.WriteField("comment", "<script>")
+	fw, _ := w.CreateFormFile("avatar", "a.svg")
+	fw.Write([]byte("<svg onload=alert(1)>"))
+	w.Close()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType(w.FormDataContentType())
+	ctx.Request.SetBody(body.Bytes())
+	parts, ok := multipartParts(ctx)
+	if !ok || len(parts) != 3 {
+		t.Fatalf("expect 2 fields and 1 file, got %v %+v", ok, parts)
+	}
+	if parts[0].label != "comment=" || string(parts[0].data) != "<script>" || parts[0].decoded != EncodingMultipart {
+		t.Errorf("unexpected field part: %+v", parts[0])
+	}
+	if parts[2].label != "a.svg (avatar): " || string(parts[2].data) != "<svg onl" {
+		t.Errorf("expect the file truncated to 8 bytes: %+v", parts[2])
+	}
+
+	ctx.Request.Header.SetContentType("text/plain")
+	if _, ok := multipartParts(ctx); ok {
+		t.Errorf("expect a non multipart body scanned raw")
+	}
+}
+
+// test --scan-json scans the string values of a json body by path
+func TestJSONParts(t *testing.T) {
+	ScanJSON = true
+	defer func() { ScanJSON = false }()
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.SetContentType("application/json; charset=utf-8")
+	ctx.Request.SetBodyString(`{"user": {"name": "<script>", "age": 3}, "tags": ["a", "b"], "a b": "c", "none": null}`)
+	parts, ok := jsonParts(ctx)
+	var got []string
+	for _, part := range parts {
+		got = append(got, part.label+string(part.data))
+	}
+	if !ok || strings.Join(got, " ") != `$["a b"]=c $.tags[0]=a $.tags[1]=b $.user.name=<script>` {
+		t.Errorf("unexpected json parts %v %q", ok, got)
+	}
+
+	ctx.Request.SetBodyString(`{"user": `)
+	if _, ok := jsonParts(ctx); ok {
+		t.Error("expect invalid json scanned raw")
+	}
+}
+
+// test invalid UTF-8 is rejected with 400 or sanitized in UTF-8 mode
+func TestInvalidUTF8(t *testing.T) {
+	Flag = "iou"
+	defer func() { Flag = "" }()
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	defer func() { ScanTargets = nil }()
+
+	ctx := doRequest(requestHandler, "/", "\xff<script>")
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusBadRequest {
+		t.Errorf("expect 400 for invalid UTF-8, got %d: %s", code, ctx.Response.Body())
+	}
+	InvalidUTF8 = InvalidUTF8Sanitize
+	defer func() { InvalidUTF8 = "" }()
+	ctx = doRequest(requestHandler, "/", "\xff<script>")
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"id":101`) {
+		t.Errorf("expect sanitized input scanned, got %s", body)
+	}
+}
+
+// test scans over --max-concurrency are rejected once the queue timeout passes
+func TestLimitConcurrency(t *testing.T) {
+	scanSlots = make(chan struct{}, 1)
+	defer func() { scanSlots = nil }()
+	ok := func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusOK) }
+
+	if code := doRequest(limitConcurrency(ok), "/", "").Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("expect 200 with a free slot, got %d", code)
+	}
+	scanSlots <- struct{}{}
+	QueueTimeout = 10 * time.Millisecond
+	defer func() { QueueTimeout = 0 }()
+	if code := doRequest(limitConcurrency(ok), "/", "").Response.StatusCode(); code != fasthttp.StatusServiceUnavailable {
+		t.Errorf("expect 503 without a free slot, got %d", code)
+	}
+}
+
+// test a disabled rule stops matching and the set is saved
+func TestDisableRule(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := disabledRules.Load(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { disabledRules = newRuleSet() }()
+
+	ctx := doRequest(ruleHandler, "/rules/101/disable", "")
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("expect 200, got %d: %s", code, ctx.Response.Body())
+	}
+	if matchResps, _ := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); len(matchResps) != 0 {
+		t.Errorf("expect disabled rule not reported, got %+v", matchResps)
+	}
+	if data, _ := ioutil.ReadFile(f.Name()); string(data) != "101\n" {
+		t.Errorf("unexpected disabled rules file: %q", data)
+	}
+	if code := doRequest(ruleHandler, "/rules/999/disable", "").Response.StatusCode(); code != fasthttp.StatusNotFound {
+		t.Errorf("expect 404 for unknown rule, got %d", code)
+	}
+
+	doRequest(ruleHandler, "/rules/101/enable", "")
+	if matchResps, _ := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); len(matchResps) != 1 {
+		t.Errorf("expect enabled rule reported, got %+v", matchResps)
+	}
+}
+
+// test a change which can't be saved is not applied
+func TestDisableRuleSaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newRuleSet()
+	if err := s.Load(filepath.Join(dir, "missing", "disabled.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(101, true); err == nil {
+		t.Fatal("expect an error saving into a missing directory")
+	}
+	if s.Has(101) || len(s.List()) != 0 {
+		t.Errorf("expect the set unchanged after a failed save, got %v", s.List())
+	}
+}
+
+func TestParseAllowIPs(t *testing.T) {
+	nets, err := parseAllowIPs([]string{"10.0.0.0/8", "192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expect := range map[string]bool{"10.1.2.3": true, "192.168.1.5": true, "192.168.1.6": false, "::1": true} {
+		allowed := false
+		for _, n := range nets {
+			allowed = allowed || n.Contains(net.ParseIP(ip))
+		}
+		if allowed != expect {
+			t.Errorf("%s allowed %v, expect %v", ip, allowed, expect)
+		}
+	}
+	if _, err := parseAllowIPs([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expect error for invalid CIDR")
+	}
+}
+
+// test forwarding headers are only believed from trusted proxies
+func TestClientIP(t *testing.T) {
+	request := func(peer, xff, realIP string) *fasthttp.RequestCtx {
+		var req fasthttp.Request
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(peer), Port: 1234}, nil)
+		return ctx
+	}
+	if ip := clientIP(request("10.0.0.1", "1.2.3.4", "")).String(); ip != "10.0.0.1" {
+		t.Errorf("expect peer without trusted proxies, got %s", ip)
+	}
+
+	var err error
+	TrustedProxies, err = parseIPNets("trusted proxy", []string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { TrustedProxies = nil }()
+	for _, c := range []struct{ peer, xff, realIP, expect string }{
+		{"10.0.0.1", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		{"fd00::1", "2001:db8::5", "", "2001:db8::5"},
+		{"10.0.0.1", "", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1", "10.0.0.3", "", "10.0.0.3"},
+		{"10.0.0.1", "bogus", "", "10.0.0.1"},
+		{"8.8.8.8", "1.2.3.4", "1.2.3.4", "8.8.8.8"},
+	} {
+		if ip := clientIP(request(c.peer, c.xff, c.realIP)).String(); ip != c.expect {
+			t.Errorf("peer %s xff %q real ip %q: expect %s, got %s", c.peer, c.xff, c.realIP, c.expect, ip)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	CORSOrigins = map[string]bool{"http://ui.local": true}
+	defer func() { CORSOrigins = nil }()
+	ok := func(ctx *fasthttp.RequestCtx) { ctx.SetStatusCode(fasthttp.StatusOK) }
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("OPTIONS")
+	ctx.Request.Header.Set("Origin", "http://ui.local")
+	cors(ok)(ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusNoContent {
+		t.Errorf("expect 204 for preflight, got %d", code)
+	}
+	if v := string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")); v != "http://ui.local" {
+		t.Errorf("unexpected allow origin %q", v)
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Origin", "http://evil.local")
+	cors(ok)(ctx)
+	if v := ctx.Response.Header.Peek("Access-Control-Allow-Origin"); len(v) != 0 || ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("expect disallowed origin served without CORS headers, got %q", v)
+	}
+}
+
+// test X-Request-ID is echoed, or generated when missing
+func TestRequestID(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("X-Request-ID", "abc-123")
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0})
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"request_id":"abc-123"`) {
+		t.Errorf("expect request id echoed, got %s", body)
+	}
+	if v := string(ctx.Response.Header.Peek("X-Request-ID")); v != "abc-123" {
+		t.Errorf("unexpected X-Request-ID header %q", v)
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("X-Request-ID", "bad\x01id")
+	if id := requestID(ctx); len(id) != 32 || id != requestID(ctx) {
+		t.Errorf("expect a stable generated id, got %q", id)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	Version, GitCommit, BuildDate = "1.2.3", "abc1234", "2020-01-01T00:00:00Z"
+	defer func() { Version, GitCommit, BuildDate = "", "", "" }()
+	ctx := doRequest(versionHandler, "/version", "")
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"version":"1.2.3","git_commit":"abc1234","build_date":"2020-01-01T00:00:00Z"`) {
+		t.Errorf("unexpected version response: %s", body)
+	}
+}
+
+func TestBulkScanHandler(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := doRequest(bulkScanHandler, "/scan/bulk", "<script>\nhello\r\n\n<img onerror=x>")
+	lines := strings.Split(strings.TrimSpace(string(ctx.Response.Body())), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 result lines, got %q", lines)
+	}
+	for i, expect := range []string{`"line":1,"errno":0`, `"line":2,"errno":1`, `"line":4,"errno":0`} {
+		if !strings.Contains(lines[i], expect) {
+			t.Errorf("line %d: expect %s, got %s", i, expect, lines[i])
+		}
+	}
+}
+
+// test every path of the request handler answers with a json Response
+func TestResponseShape(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	defer func() { ScanTargets = nil }()
+
+	cases := []struct {
+		name    string
+		body    string
+		status  int
+		errno   int
+		setup   func()
+		cleanup func()
+	}{
+		{name: "match", body: "<script>", status: 200, errno: 0},
+		{name: "no match", body: "hello", status: 200, errno: 1},
+		{name: "invalid utf-8", body: "\xff<script>", status: 400, errno: -1,
+			setup: func() { Flag = "iou"; buildScratch("patterns/xss.txt") }, cleanup: func() { Flag = ""; buildScratch("patterns/xss.txt") }},
+		{name: "oversized", body: "<script> and more", status: 413, errno: -3,
+			setup: func() { MaxScanBytes, Oversize = 4, OversizeReject }, cleanup: func() { MaxScanBytes, Oversize = 0, "" }},
+		{name: "allowed", body: "<script>", status: 200, errno: 2,
+			setup: func() { AllowPaths = [][]byte{[]byte("/")} }, cleanup: func() { AllowPaths = nil }},
+		{name: "rate limited", body: "<script>", status: 429, errno: -4,
+			setup: func() { RateLimit, RateBurst = 0.001, 1 }, cleanup: func() { RateLimit, RateBurst = 0, 0 }},
+		{name: "busy", body: "<script>", status: 503, errno: -5,
+			setup: func() { scanSlots = make(chan struct{}, 1); scanSlots <- struct{}{} }, cleanup: func() { scanSlots = nil }},
+	}
+	ContentType = "application/json; charset=utf-8"
+	defer func() { ContentType = "" }()
+	for _, c := range cases {
+		if c.setup != nil {
+			c.setup()
+		}
+		h := rateLimit(limitConcurrency(requestHandler))
+		ctx := doRequest(h, "/", c.body)
+		if c.name == "rate limited" {
+			ctx = doRequest(h, "/", c.body)
+		}
+		if c.cleanup != nil {
+			c.cleanup()
+		}
+
+		var resp Response
+		if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+			t.Errorf("%s: invalid json %q: %s", c.name, ctx.Response.Body(), err)
+			continue
+		}
+		if code := ctx.Response.StatusCode(); code != c.status || resp.Errno != c.errno {
+			t.Errorf("%s: expect %d errno %d, got %d errno %d", c.name, c.status, c.errno, code, resp.Errno)
+		}
+		if ct := string(ctx.Response.Header.ContentType()); ct != ContentType {
+			t.Errorf("%s: unexpected content type %q", c.name, ct)
+		}
+	}
+}
+
+// test blocked requests are answered with --block-template, others keep json
+func TestBlockTemplate(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	Block = true
+	var err error
+	blockTemplate, err = loadBlockTemplate("templates/block.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	BlockContentType = "text/html; charset=utf-8"
+	defer func() { ScanTargets, Block, blockTemplate, BlockContentType = nil, false, nil, "" }()
+
+	ctx := doRequest(requestHandler, "/login", "<script>")
+	body := string(ctx.Response.Body())
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusForbidden || !strings.Contains(body, "to /login was blocked") || !strings.Contains(body, "rule 101") {
+		t.Errorf("expect block page, got %d: %s", code, body)
+	}
+	if ct := string(ctx.Response.Header.ContentType()); ct != BlockContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	ctx = doRequest(requestHandler, "/login", "hello")
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"errno":1`) {
+		t.Errorf("expect json for a request not blocked, got %s", body)
+	}
+
+	/* fail closed on a scan error, nothing matched */
+	saved := scanBreaker
+	scanBreaker = &breaker{threshold: 1, cooldown: time.Hour}
+	defer func() { scanBreaker = saved }()
+	scanBreaker.record(&engineError{errors.New("hs error")}, time.Now(), false)
+	ctx = doRequest(requestHandler, "/login", "hello")
+	body = string(ctx.Response.Body())
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusForbidden || strings.Contains(body, "was blocked") || !strings.Contains(body, `"errno":-2`) {
+		t.Errorf("expect the json error for a scan failure, got %d: %s", code, body)
+	}
+}
+
+// test blocked responses carry the data of the matched rule as reason
+func TestBlockReason(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	Block, BlockReasonHeader = true, true
+	defer func() { ScanTargets, Block, BlockReasonHeader = nil, false, false }()
+
+	ctx := doRequest(requestHandler, "/", "<script>")
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"reason":"{\"type\":\"xss\", \"name\":\"script tag\"}"`) {
+		t.Errorf("expect the rule data as reason, got %s", body)
+	}
+	if h := string(ctx.Response.Header.Peek("X-WAF-Block-Reason")); h != `{"type":"xss", "name":"script tag"}` {
+		t.Errorf("unexpected reason header %q", h)
+	}
+	if v := headerValue("a\r\nSet-Cookie: x" + strings.Repeat("中", 100)); strings.ContainsAny(v, "\r\n") || len(v) > maxHeaderReason || !utf8.ValidString(v) {
+		t.Errorf("unsafe header value %q", v)
+	}
+}
+
+// test POST /test scans with a pattern of its own, leaving the loaded rules alone
+func TestPatternHandler(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	loaded := currentEngine()
+	ctx := doRequest(testPatternHandler, "/test", `{"expr": "union\\s+select", "flags": "il", "input": "1 UNION  select 2"}`)
+	body := string(ctx.Response.Body())
+	if !strings.Contains(body, `"errno":0`) || !strings.Contains(body, `"from":2,"to":15`) || !strings.Contains(body, `"matched":"UNION  select"`) {
+		t.Errorf("unexpected test result %s", body)
+	}
+	if currentEngine() != loaded || len(loaded.regexMap) != 2 {
+		t.Error("expect the loaded rules untouched")
+	}
+
+	ctx = doRequest(testPatternHandler, "/test", `{"expr": "(", "input": "x"}`)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusBadRequest {
+		t.Errorf("expect 400 for a broken pattern, got %d", code)
+	}
+}
+
+func TestRuleWarningsHandler(t *testing.T) {
+	path := writeRules(t, "1\tabc\tdata\n2\tx*\tdata\te\n3\t.*a.*b\tdata\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx := doRequest(ruleWarningsHandler, "/rules/warnings", "")
+	var resp struct {
+		Data []RuleWarningsResp
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 || resp.Data[0].Id != 2 || resp.Data[1].Id != 3 {
+		t.Errorf("expect warnings of rules 2 and 3, got %+v", resp.Data)
+	}
+	if strings.Contains(string(doRequest(ruleHandler, "/rules/1", "").Response.Body()), "warnings") {
+		t.Error("expect warnings left out of rule responses")
+	}
+}
+
+func TestMinimalResponse(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	Block, ResponseMode = true, ResponseMinimal
+	defer func() { ScanTargets, Block, ResponseMode = nil, false, "" }()
+
+	for body, expect := range map[string]string{"<script>": `{"block":true,"rule":101}`, "hello": `{"block":false}`} {
+		ctx := doRequest(requestHandler, "/", body)
+		if got := string(ctx.Response.Body()); got != expect {
+			t.Errorf("%s: expect %s, got %s", body, expect, got)
+		}
+	}
+}
+
+// test API endpoints answer a wrong method with 405 and the methods they accept
+func TestMethods(t *testing.T) {
+	for _, c := range []struct{ method, uri, allow string }{
+		{"GET", "/reload", "POST"},
+		{"GET", "/scan", "POST"},
+		{"PUT", "/rules", "GET, HEAD"},
+		{"POST", "/version", "GET, HEAD"},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(c.method)
+		ctx.Request.SetRequestURI(c.uri)
+		router(ctx)
+		if code := ctx.Response.StatusCode(); code != fasthttp.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expect 405, got %d", c.method, c.uri, code)
+		}
+		if allow := string(ctx.Response.Header.Peek("Allow")); allow != c.allow {
+			t.Errorf("%s %s: expect Allow %q, got %q", c.method, c.uri, c.allow, allow)
+		}
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/version")
+	router(ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("GET /version: expect 200, got %d", code)
+	}
+}
+
+// test /info reports the memory of the compiled rules
+func TestInfoSizes(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	infoHandler(ctx)
+	var resp struct {
+		Data InfoResp `json:"data"`
+	}
+	if err := json.Unmarshal(ctx.Response.Body(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.DbSize <= 0 || resp.Data.ScratchSize <= 0 {
+		t.Errorf("expect database and scratch sizes, got %+v", resp.Data)
+	}
+}
+
+// test --read-timeout drops a client which never finishes its request
+func TestServerReadTimeout(t *testing.T) {
+	ReadTimeout = 100 * time.Millisecond
+	defer func() { ReadTimeout = 0 }()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(func(ctx *fasthttp.RequestCtx) {})
+	go server.Serve(ln)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("expect the server to close the slow connection, got %v", err)
+	}
+}
+
+// test every match tells the request part it came from
+func TestMatchLocation(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetURI: true, TargetHeaders: true, TargetCookies: true, TargetBody: true}
+	ScanArgs = true
+	defer func() { ScanTargets, ScanArgs = nil, false }()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/search?q=%3Cscript%3E")
+	ctx.Request.Header.Set("User-Agent", "<script>")
+	ctx.Request.Header.Set("Cookie", "theme=onload=x")
+	ctx.Request.SetBodyString("<script>")
+	matchResps, err := scanParts(requestParts(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations := make(map[string]bool)
+	for _, m := range matchResps {
+		locations[m.Location] = true
+	}
+	for _, want := range []string{"arg:q", "header:User-Agent", "cookie:theme", "body"} {
+		if !locations[want] {
+			t.Errorf("no match at %s: %v", want, locations)
+		}
+	}
+}
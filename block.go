@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"html/template"
+	"time"
+)
+
+var (
+	/* page rendered for blocked requests instead of json, see --block-template */
+	blockTemplate    *template.Template
+	BlockContentType string
+
+	BlockReasonHeader bool /* echo Response.Reason as X-WAF-Block-Reason */
+)
+
+/* what a --block-template can show */
+type BlockPage struct {
+	RequestID string
+	ClientIP  string
+	Method    string
+	Path      string
+	Time      time.Time
+	Reason    string /* data of the rule the request is blocked for */
+	Matches   []MatchResp
+}
+
+// parse --block-template, html escaping applies to everything it renders
+func loadBlockTemplate(path string) (*template.Template, error) {
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("block template: %s", err)
+	}
+	return t, nil
+}
+
+// render the block page for a blocked request, false when there is no
+// template or it fails, the caller then answers with json as usual
+func writeBlockPage(ctx *fasthttp.RequestCtx, status int, matchResps []MatchResp) bool {
+	if blockTemplate == nil {
+		return false
+	}
+	page := BlockPage{
+		RequestID: requestID(ctx),
+		ClientIP:  clientIP(ctx).String(),
+		Method:    string(ctx.Method()),
+		Path:      string(ctx.Path()),
+		Time:      time.Now(),
+		Reason:    blockReason(matchResps),
+		Matches:   matchResps,
+	}
+	var buf bytes.Buffer
+	if err := blockTemplate.Execute(&buf, page); err != nil {
+		log.Error(fmt.Sprintf("render block template: %s", err))
+		return false
+	}
+	ctx.Response.Header.Set("Content-Type", BlockContentType)
+	ctx.Response.Header.Set("X-Request-ID", page.RequestID)
+	ctx.Response.SetBody(buf.Bytes())
+	ctx.Response.SetStatusCode(status)
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"sync"
+	"time"
+)
+
+/* breaker states reported by /healthz */
+const (
+	BreakerClosed   = "closed"    /* scanning */
+	BreakerOpen     = "open"      /* not scanning until the cooldown ends */
+	BreakerHalfOpen = "half-open" /* cooldown over, a single probe scan decides */
+)
+
+/* returned instead of scanning while the breaker is open */
+var errBreakerOpen = errors.New("scanning disabled after repeated scan errors")
+
+// breaker stops scanning after threshold consecutive scan errors, as a broken
+// database fails every scan, and retries after cooldown
+type breaker struct {
+	sync.Mutex
+	threshold int /* 0 never trips */
+	cooldown  time.Duration
+	failures  int       /* consecutive */
+	openUntil time.Time /* zero while closed */
+	probing   bool      /* half open and the probe scan admitted, until its record */
+	trips     uint64
+}
+
+/* guards scans of requestHandler, see --breaker-threshold */
+var scanBreaker = &breaker{}
+
+// false while scanning is disabled. Half open only the first caller scans, as the
+// probe, the others are refused until its outcome is recorded; probe tells that
+// caller apart, it passes it on to record
+func (b *breaker) allow(now time.Time) (ok, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+	switch b.stateLocked(now) {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// count the outcome of a scan. Only an *engineError is a failure, a timed out
+// scan still ran fine while any other error is about the input and says nothing
+// about the database. Either way the probe is over once it is recorded, the
+// next scan allowed half open probes again; a scan which was already running
+// when the breaker went half open doesn't end it.
+func (b *breaker) record(err error, now time.Time, probe bool) {
+	b.Lock()
+	defer b.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err == errScanTimeout {
+		err = nil
+	}
+	if _, ok := err.(*engineError); err != nil && !ok {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		/* also when half open, a failed retry opens again for a full cooldown */
+		if b.openUntil.IsZero() || !now.Before(b.openUntil) {
+			b.trips++
+			log.Error(fmt.Sprintf("%d consecutive scan errors, last: %s, stop scanning for %s", b.failures, err, b.cooldown))
+		}
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+func (b *breaker) state(now time.Time) string {
+	b.Lock()
+	defer b.Unlock()
+	return b.stateLocked(now)
+}
+
+func (b *breaker) stateLocked(now time.Time) string {
+	switch {
+	case b.openUntil.IsZero():
+		return BreakerClosed
+	case now.Before(b.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+/* GET /healthz data */
+type HealthResp struct {
+	Breaker   string     `json:"breaker"`
+	Failures  int        `json:"consecutive_errors"`
+	Trips     uint64     `json:"trips"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// GET /healthz, 503 while the breaker keeps requests from being scanned
+func healthzHandler(ctx *fasthttp.RequestCtx) {
+	scanBreaker.Lock()
+	resp := HealthResp{Breaker: scanBreaker.stateLocked(time.Now()), Failures: scanBreaker.failures, Trips: scanBreaker.trips}
+	if resp.Breaker == BreakerOpen {
+		openUntil := scanBreaker.openUntil
+		resp.OpenUntil = &openUntil
+	}
+	scanBreaker.Unlock()
+
+	if resp.Breaker == BreakerOpen {
+		writeJSON(ctx, fasthttp.StatusServiceUnavailable, Response{Errno: -2, Msg: errBreakerOpen.Error(), Data: resp})
+		return
+	}
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: resp})
+}
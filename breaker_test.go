@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: time.Second}
+	now := time.Now()
+	scanErr := &engineError{errors.New("hs error")}
+
+	b.record(scanErr, now, false)
+	b.record(&invalidUTF8Error{}, now, false)
+	b.record(errors.New("bad input"), now, false)
+	if ok, _ := b.allow(now); !ok || b.state(now) != BreakerClosed || b.failures != 1 {
+		t.Fatal("expect closed below threshold, input errors not counted")
+	}
+	b.record(scanErr, now, false)
+	if ok, _ := b.allow(now); ok || b.state(now) != BreakerOpen || b.trips != 1 {
+		t.Fatalf("expect open after 2 errors, got %s", b.state(now))
+	}
+
+	later := now.Add(time.Second)
+	ok, probe := b.allow(later)
+	if !ok || !probe || b.state(later) != BreakerHalfOpen {
+		t.Fatalf("expect a probe half open after the cooldown, got %s", b.state(later))
+	}
+	b.record(scanErr, later, probe)
+	if ok, _ := b.allow(later); ok || b.trips != 2 {
+		t.Error("expect a failed retry to open again")
+	}
+
+	b.record(nil, later.Add(time.Second), false)
+	if b.state(later) != BreakerClosed || b.failures != 0 {
+		t.Error("expect a successful scan to close")
+	}
+}
+
+// test half open admits a single probe among concurrent requests
+func TestBreakerSingleProbe(t *testing.T) {
+	b := &breaker{threshold: 1, cooldown: time.Second}
+	now := time.Now()
+	b.record(&engineError{errors.New("hs error")}, now, false)
+	later := now.Add(time.Second)
+
+	var wg sync.WaitGroup
+	var allowed, probes int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, probe := b.allow(later); ok {
+				atomic.AddInt32(&allowed, 1)
+				if probe {
+					atomic.AddInt32(&probes, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 || probes != 1 {
+		t.Fatalf("expect 1 probe half open, got %d allowed, %d probes", allowed, probes)
+	}
+	if ok, _ := b.allow(later); ok {
+		t.Error("expect no second probe before the first is recorded")
+	}
+
+	/* a scan admitted before the breaker opened doesn't end the probe */
+	b.record(&invalidUTF8Error{}, later, false)
+	if ok, _ := b.allow(later); ok {
+		t.Error("expect a scan started earlier not to end the probe")
+	}
+
+	/* a probe rejected before scanning decides nothing, the next request probes */
+	b.record(&invalidUTF8Error{}, later, true)
+	if ok, probe := b.allow(later); !ok || !probe {
+		t.Error("expect a new probe after an undecided one")
+	}
+	if ok, _ := b.allow(later); ok {
+		t.Error("expect a single new probe after an undecided one")
+	}
+	b.record(nil, later, true)
+	for i := 0; i < 2; i++ {
+		if ok, probe := b.allow(later); !ok || probe {
+			t.Error("expect every request allowed after a successful probe")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"sync"
+	"sync/atomic"
+)
+
+/* longer inputs are always scanned, they rarely repeat and would crowd the cache */
+const cacheMaxInput = 4096
+
+/* a match as reported by hyperscan, before any filtering */
+type rawMatch struct {
+	id       uint
+	from, to uint64
+	flags    uint
+}
+
+// resultCache is an LRU of scan input => raw matches, see --cache-size.
+// Each engine has its own, so a reload starts with an empty cache.
+type resultCache struct {
+	sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	matches []rawMatch
+}
+
+var (
+	/* cache lookups, reported by /stats */
+	cacheHits   uint64
+	cacheMisses uint64
+)
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{size: size, ll: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+func (c *resultCache) Get(key []byte) ([]rawMatch, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.items[string(key)]
+	if !ok {
+		atomic.AddUint64(&cacheMisses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&cacheHits, 1)
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).matches, true
+}
+
+// Add records matches of key, evicting the least recently used entry when full
+func (c *resultCache) Add(key []byte, matches []rawMatch) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.items[string(key)]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*cacheEntry).matches = matches
+		return
+	}
+	entry := &cacheEntry{key: string(key), matches: matches}
+	c.items[entry.key] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *resultCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len()
+}
+
+// scan data through the result cache of e, a hit replays the recorded matches to
+// handler without running hyperscan. Only complete scans are recorded, one stopped
+// by the handler, e.g. with --first-match, may miss later matches.
+func (e *engine) scanCached(data []byte, scratch *hyperscan.Scratch, handler hyperscan.MatchHandler) error {
+	if e.cache == nil || len(data) > cacheMaxInput {
+		return e.scan(data, scratch, handler, nil)
+	}
+	if matches, ok := e.cache.Get(data); ok {
+		for _, m := range matches {
+			if handler(m.id, m.from, m.to, m.flags, nil) != nil {
+				return hyperscan.HsError(hyperscan.ErrScanTerminated)
+			}
+		}
+		return nil
+	}
+	var matches []rawMatch
+	err := e.scan(data, scratch, func(id uint, from, to uint64, flags uint, context interface{}) error {
+		matches = append(matches, rawMatch{id, from, to, flags})
+		return handler(id, from, to, flags, context)
+	}, nil)
+	if err == nil {
+		e.cache.Add(data, matches)
+	}
+	return err
+}
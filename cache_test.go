@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestResultCache(t *testing.T) {
+	c := newResultCache(2)
+	c.Add([]byte("a"), []rawMatch{{id: 1}})
+	c.Add([]byte("b"), nil)
+	c.Get([]byte("a"))
+	c.Add([]byte("c"), nil)
+	if _, ok := c.Get([]byte("b")); ok {
+		t.Error("expect least recently used entry evicted")
+	}
+	if m, ok := c.Get([]byte("a")); !ok || len(m) != 1 || m[0].id != 1 {
+		t.Errorf("expect recently used entry kept, got %v %v", m, ok)
+	}
+}
+
+// test repeated inputs are answered from the cache and a reload empties it
+func TestScanCached(t *testing.T) {
+	CacheSize = 16
+	defer func() { CacheSize = 0 }()
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	hits := atomic.LoadUint64(&cacheHits)
+	for i := 0; i < 3; i++ {
+		matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")})
+		if err != nil || len(matchResps) != 1 || matchResps[0].Id != 101 {
+			t.Fatalf("scan %d: unexpected matches %+v, %v", i, matchResps, err)
+		}
+	}
+	if n := atomic.LoadUint64(&cacheHits) - hits; n != 2 {
+		t.Errorf("expect 2 cache hits, got %d", n)
+	}
+
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if n := currentEngine().cache.Len(); n != 0 {
+		t.Errorf("expect an empty cache after reload, got %d entries", n)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+/* settings never printed by the config command, matched as part of the key */
+var secretKeys = []string{"token", "secret", "password", "rules-header"}
+
+// validate compiles the rules like the server does, for CI checks before a deploy
+func validate(cmd *cobra.Command, args []string) error {
+	if err := buildScratch(FilePaths...); err != nil {
+		return err
+	}
+	e := currentEngine()
+	fmt.Printf("%d rules from %d files compiled ok\n", len(e.regexMap), len(e.filepaths))
+	return nil
+}
+
+// scan matches a payload from stdin or --input, a local loop for rule authors
+func scan(cmd *cobra.Command, args []string) error {
+	data, err := readInput(viper.GetString("scan.input"))
+	if err != nil {
+		return err
+	}
+	if err := buildScratch(FilePaths...); err != nil {
+		return err
+	}
+
+	matchResps, err := scanRequestPart(scanPart{target: "input", data: data})
+	if _, ok := err.(*invalidUTF8Error); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Db.Scan error: %s", err)
+	}
+	resp := Response{Errno: 0, Data: matchResps}
+	if len(matchResps) <= 0 {
+		resp.Errno = 1
+		resp.Msg = "no match"
+	}
+	out, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// read path, stdin when empty
+func readInput(path string) ([]byte, error) {
+	if path == "" {
+		for _, p := range FilePaths {
+			if p == StdinPath {
+				return nil, fmt.Errorf("stdin is read for --filepath -, give the input with --input")
+			}
+		}
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// bench scans a sample for --duration on --concurrency goroutines, for capacity planning
+func bench(cmd *cobra.Command, args []string) error {
+	data, err := readInput(viper.GetString("bench.input"))
+	if err != nil {
+		return err
+	}
+	duration := viper.GetDuration("bench.duration")
+	if duration <= 0 {
+		return fmt.Errorf("--duration must be positive")
+	}
+	concurrency := viper.GetInt("bench.concurrency")
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if PoolSize < concurrency {
+		PoolSize = concurrency
+	}
+	if err := buildScratch(FilePaths...); err != nil {
+		return err
+	}
+
+	/* each scanner keeps its own latencies, merged at the end */
+	latencies := make([][]time.Duration, concurrency)
+	matches := make([]int, concurrency)
+	errs := make(chan error, concurrency)
+	deadline := time.Now().Add(duration)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				matchResps, err := scanRequestPart(scanPart{target: "input", data: data})
+				if err != nil {
+					errs <- err
+					return
+				}
+				latencies[i] = append(latencies[i], time.Since(t))
+				matches[i] += len(matchResps)
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return fmt.Errorf("Db.Scan error: %s", err)
+	}
+
+	var all []time.Duration
+	var matchCount int
+	for i := range latencies {
+		all = append(all, latencies[i]...)
+		matchCount += matches[i]
+	}
+	if len(all) == 0 {
+		return fmt.Errorf("no scan finished in %s", duration)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	seconds := elapsed.Seconds()
+	fmt.Printf("rules: %d, input: %d bytes, concurrency: %d, duration: %s\n", len(currentEngine().regexMap), len(data), concurrency, elapsed)
+	fmt.Printf("scans: %d, %.1f scans/s, %.2f MB/s\n", len(all), float64(len(all))/seconds, float64(len(all))*float64(len(data))/seconds/1e6)
+	fmt.Printf("latency: p50 %s, p99 %s, max %s\n", percentile(all, 50), percentile(all, 99), all[len(all)-1])
+	fmt.Printf("matches: %d, %.1f matches/s\n", matchCount, float64(matchCount)/seconds)
+	return nil
+}
+
+// p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// dumpConfig prints the settings viper resolved, for finding out which of
+// flags, env and --config set the port or filepath in effect
+func dumpConfig(cmd *cobra.Command, args []string) error {
+	if config := viper.GetString("config"); config != "" {
+		if err := readConfig(cmd, config); err != nil {
+			return fmt.Errorf("read config %s: %s", config, err)
+		}
+	}
+	settings := redactSettings(viper.AllSettings())
+
+	var out []byte
+	var err error
+	switch format := viper.GetString("dump.format"); format {
+	case "json":
+		out, err = json.MarshalIndent(settings, "", "  ")
+	case "yaml":
+		out, err = yaml.Marshal(settings)
+	default:
+		return fmt.Errorf("unknown format: %s, expect json or yaml", format)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimSpace(string(out)))
+	return nil
+}
+
+// replace the values of secretKeys that are set
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	for key, value := range settings {
+		for _, secret := range secretKeys {
+			if strings.Contains(key, secret) && fmt.Sprint(value) != "" && fmt.Sprint(value) != "[]" {
+				settings[key] = "***"
+			}
+		}
+	}
+	return settings
+}
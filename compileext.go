@@ -0,0 +1,82 @@
+package main
+
+/*
+#cgo pkg-config: libhs
+#cgo linux LDFLAGS: -lm -lstdc++
+#cgo darwin LDFLAGS: -lstdc++
+
+#include <stdlib.h>
+
+#include <hs.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"unsafe"
+)
+
+// compile patterns with their extended parameters by hs_compile_ext_multi, which the
+// vendored gohs doesn't expose, into a serialized database for hyperscan.Unmarshal*Database.
+// A nil ext is no extended parameters for that pattern. Everything handed to the
+// compiler lives in C memory, the ext pointer array is not allowed to point into Go memory.
+func compileExtMulti(patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt, mode hyperscan.ModeFlag) ([]byte, error) {
+	n := len(patterns)
+	if n == 0 {
+		return nil, fmt.Errorf("no patterns")
+	}
+
+	cexprs := (*[1 << 20]*C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))[:n:n]
+	cflags := (*[1 << 20]C.uint)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.uint(0)))))[:n:n]
+	cids := (*[1 << 20]C.uint)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.uint(0)))))[:n:n]
+	cexts := (*[1 << 20]*C.hs_expr_ext_t)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.hs_expr_ext_t)(nil)))))[:n:n]
+	defer func() {
+		for i := range cexprs {
+			C.free(unsafe.Pointer(cexprs[i]))
+			if cexts[i] != nil {
+				C.free(unsafe.Pointer(cexts[i]))
+			}
+		}
+		C.free(unsafe.Pointer(&cexprs[0]))
+		C.free(unsafe.Pointer(&cflags[0]))
+		C.free(unsafe.Pointer(&cids[0]))
+		C.free(unsafe.Pointer(&cexts[0]))
+	}()
+
+	for i, p := range patterns {
+		cexprs[i] = C.CString(string(p.Expression))
+		cflags[i] = C.uint(p.Flags)
+		cids[i] = C.uint(p.Id)
+		cexts[i] = nil
+		if i < len(exts) && exts[i] != nil {
+			ext := (*C.hs_expr_ext_t)(C.calloc(1, C.size_t(unsafe.Sizeof(C.hs_expr_ext_t{}))))
+			ext.flags = C.ulonglong(exts[i].Flags)
+			ext.min_offset = C.ulonglong(exts[i].MinOffset)
+			ext.max_offset = C.ulonglong(exts[i].MaxOffset)
+			ext.min_length = C.ulonglong(exts[i].MinLength)
+			ext.edit_distance = C.uint(exts[i].EditDistance)
+			cexts[i] = ext
+		}
+	}
+
+	var db *C.hs_database_t
+	var cerr *C.hs_compile_error_t
+	ret := C.hs_compile_ext_multi(&cexprs[0], &cflags[0], &cids[0], &cexts[0], C.uint(n), C.uint(mode), nil, &db, &cerr)
+	if ret != C.HS_SUCCESS {
+		if cerr == nil {
+			return nil, fmt.Errorf("compile error, %d", int(ret))
+		}
+		defer C.hs_free_compile_error(cerr)
+		return nil, fmt.Errorf("%s", C.GoString(cerr.message))
+	}
+	defer C.hs_free_database(db)
+
+	var data *C.char
+	var length C.size_t
+	if ret := C.hs_serialize_database(db, &data, &length); ret != C.HS_SUCCESS {
+		return nil, hyperscan.HsError(ret)
+	}
+	defer C.free(unsafe.Pointer(data))
+	return C.GoBytes(unsafe.Pointer(data), C.int(length)), nil
+}
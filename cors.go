@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/valyala/fasthttp" /* http parse lib */
+)
+
+/* origins allowed to call the json api from a browser, see --cors-origin. "*" allows any */
+var CORSOrigins map[string]bool
+
+// add CORS headers for allowed origins to the responses of h and answer OPTIONS preflights
+func cors(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if len(CORSOrigins) == 0 {
+			h(ctx)
+			return
+		}
+		origin := string(ctx.Request.Header.Peek("Origin"))
+		allowed := origin != "" && (CORSOrigins["*"] || CORSOrigins[origin])
+		ctx.Response.Header.Add("Vary", "Origin")
+		if allowed {
+			ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !ctx.IsOptions() {
+			h(ctx)
+			return
+		}
+
+		/* preflight, answered without running h */
+		if allowed {
+			ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			ctx.Response.Header.Set("Access-Control-Max-Age", "600")
+		}
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}
+}
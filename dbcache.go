@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"  /* structured logger lib */
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/* first line of a --db-cache file, followed by the hash of the patterns it was compiled from */
+const dbCacheMagic = "hwaf-db-cache"
+
+// compile patterns in block mode. With a cache file the database stored there is used
+// when it was compiled from the same patterns, otherwise it is compiled and stored.
+func compileBlockDatabase(path string, patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt) (hyperscan.BlockDatabase, error) {
+	if path == "" {
+		return newBlockDatabase(patterns, exts)
+	}
+	hash := patternsHash(patterns, exts)
+	db, err := loadCachedDatabase(path, hash)
+	if err == nil {
+		log.Info(fmt.Sprintf("loaded compiled database from %s", path))
+		return db, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Info(fmt.Sprintf("db cache %s not used, compiling: %s", path, err))
+	}
+
+	db, err = newBlockDatabase(patterns, exts)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCachedDatabase(path, hash, db); err != nil {
+		log.Warn(fmt.Sprintf("save db cache %s: %s", path, err))
+	}
+	return db, nil
+}
+
+// fingerprint of what a database is compiled from, the hyperscan version included
+// as serialized databases only load into the version which wrote them
+func patternsHash(patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", hyperscan.Version())
+	for i, p := range patterns {
+		var ext *hyperscan.ExprExt
+		if exts != nil {
+			ext = exts[i]
+		}
+		fmt.Fprintf(h, "%d\t%d\t%s\t%s\n", p.Id, p.Flags, p.Expression, formatExprExt(ext))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadCachedDatabase(path string, hash string) (hyperscan.BlockDatabase, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte(dbCacheMagic + " " + hash + "\n")
+	if !bytes.HasPrefix(content, header) {
+		return nil, fmt.Errorf("compiled from other rules")
+	}
+	return hyperscan.UnmarshalBlockDatabase(content[len(header):])
+}
+
+// write through a temp file, a crash never leaves a truncated cache behind
+func saveCachedDatabase(path string, hash string, db hyperscan.BlockDatabase) error {
+	data, err := db.Marshal()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "%s %s\n", dbCacheMagic, hash)
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
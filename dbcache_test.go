@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// test --db-cache stores the database and only reuses it for the same rules
+func TestDbCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hwaf-db-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	DbCache = dir + "/rules.db"
+	defer func() { DbCache = "" }()
+
+	path := writeRules(t, "1\t<script\tdata\n")
+	defer os.Remove(path)
+	header := func() string {
+		content, err := ioutil.ReadFile(DbCache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.SplitN(string(content), "\n", 2)[0]
+	}
+
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	first := header()
+	if !strings.HasPrefix(first, dbCacheMagic+" ") {
+		t.Fatalf("unexpected cache header %q", first)
+	}
+	/* loaded from the cache this time */
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); err != nil || len(matchResps) != 1 {
+		t.Errorf("expect cached database to match, got %v %+v", err, matchResps)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("1\t<iframe\tdata\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if header() == first {
+		t.Error("expect changed rules to replace the stale cache")
+	}
+	if matchResps, _ := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); len(matchResps) != 0 {
+		t.Errorf("expect the stale database not used, got %+v", matchResps)
+	}
+}
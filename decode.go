@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// decompress body of a Content-Encoding, output over max bytes is cut and truncated set.
+// An unsupported encoding returns an error, so the raw body is scanned instead.
+func decodeBody(encoding string, body []byte, max int) (decoded []byte, truncated bool, err error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case EncodingGzip, "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, err
+		}
+		defer gr.Close()
+		r = gr
+	case EncodingDeflate:
+		/* deflate should be zlib wrapped, but some clients send raw deflate */
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(body))
+			defer fr.Close()
+			r = fr
+		} else {
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+
+	/* read one more byte to tell a body of exactly max bytes from a bomb */
+	if max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	decoded, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	if max > 0 && len(decoded) > max {
+		return decoded[:max], true, nil
+	}
+	return decoded, false, nil
+}
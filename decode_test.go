@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	payload := []byte("<script>alert(1)</script>")
+	compress := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"Deflate": func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw },
+	}
+	for encoding, newWriter := range compress {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		w.Write(payload)
+		w.Close()
+
+		decoded, truncated, err := decodeBody(encoding, buf.Bytes(), 0)
+		if err != nil || truncated || !bytes.Equal(decoded, payload) {
+			t.Errorf("%s: got %q, %v, %v", encoding, decoded, truncated, err)
+		}
+		decoded, truncated, err = decodeBody(encoding, buf.Bytes(), 8)
+		if err != nil || !truncated || !bytes.Equal(decoded, payload[:8]) {
+			t.Errorf("%s capped: got %q, %v, %v", encoding, decoded, truncated, err)
+		}
+	}
+
+	if _, _, err := decodeBody("br", payload, 0); err == nil {
+		t.Error("expect error for unsupported encoding")
+	}
+	if _, _, err := decodeBody("gzip", payload, 0); err == nil {
+		t.Error("expect error for a body which is not gzip")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"sort"
+)
+
+// drop the matches of one scan part overlapping a match of an allow rule, and the
+// allow matches themselves. Allow rules have the l flag, their From is exact; a
+// match of another rule without it starts at 0 and overlaps when it ends after From.
+func suppressAllowed(matchResps []MatchResp) []MatchResp {
+	var allows []MatchResp
+	for _, m := range matchResps {
+		if m.RegexLinev.Action == ActionAllow {
+			allows = append(allows, m)
+		}
+	}
+	if len(allows) <= 0 {
+		return matchResps
+	}
+
+	kept := matchResps[:0]
+	for _, m := range matchResps {
+		if m.RegexLinev.Action == ActionAllow {
+			continue
+		}
+		suppressed := false
+		for _, a := range allows {
+			if m.From < a.To && a.From < m.To {
+				log.Debug(fmt.Sprintf("rule %d at %d-%d suppressed by allow rule %d", m.Id, m.From, m.To, a.Id))
+				suppressed = true
+				break
+			}
+		}
+		if !suppressed {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// --once-per-id, --max-matches and --first-match on the matches of every part left
+// by suppressAllowed, in the order they were reported. The scan can't stop early
+// when there are allow rules, a suppressed match would use up the limits and
+// hide a later one. True when more than --max-matches were left.
+func limitMatches(matches [][]MatchResp) bool {
+	limit := MaxMatches
+	if FirstMatch {
+		limit = 1
+	}
+	reported := make(map[int]bool)
+	total, tooMany := 0, false
+	for i, part := range matches {
+		kept := part[:0]
+		for _, m := range part {
+			if OncePerID && reported[m.Id] {
+				continue
+			}
+			if limit > 0 && total >= limit {
+				tooMany = !FirstMatch
+				break
+			}
+			total++
+			reported[m.Id] = true
+			kept = append(kept, m)
+		}
+		matches[i] = kept
+	}
+	return tooMany
+}
+
+// merge overlapping matches of one scan part, the merged range is reported by
+// the highest severity rule and Ids lists every rule merged into it.
+func dedupMatches(matchResps []MatchResp) []MatchResp {
+	if len(matchResps) <= 1 {
+		return matchResps
+	}
+	sort.SliceStable(matchResps, func(i, j int) bool {
+		if matchResps[i].From != matchResps[j].From {
+			return matchResps[i].From < matchResps[j].From
+		}
+		return matchResps[i].To < matchResps[j].To
+	})
+
+	merged := []MatchResp{}
+	for _, m := range matchResps {
+		n := len(merged)
+		if n <= 0 || m.From >= merged[n-1].To {
+			m.Ids = []int{m.Id}
+			merged = append(merged, m)
+			continue
+		}
+
+		cur := &merged[n-1]
+		if m.To > cur.To {
+			cur.To = m.To
+		}
+		if !containsId(cur.Ids, m.Id) {
+			cur.Ids = append(cur.Ids, m.Id)
+		}
+		if severityRank(m.RegexLinev.Severity) > severityRank(cur.RegexLinev.Severity) {
+			cur.Id = m.Id
+			cur.Flags = m.Flags
+			cur.RegexLinev = m.RegexLinev
+		}
+	}
+	return merged
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDedupMatches(t *testing.T) {
+	matchResps := []MatchResp{
+		{Id: 1, From: 0, To: 5, RegexLinev: RegexLine{Severity: "low"}},
+		{Id: 2, From: 2, To: 8, RegexLinev: RegexLine{Severity: "high"}},
+		{Id: 1, From: 0, To: 5, RegexLinev: RegexLine{Severity: "low"}},
+		{Id: 3, From: 10, To: 12},
+	}
+	merged := dedupMatches(matchResps)
+	if len(merged) != 2 {
+		t.Fatalf("expect 2 merged matches, got %+v", merged)
+	}
+	if m := merged[0]; m.Id != 2 || m.From != 0 || m.To != 8 || len(m.Ids) != 2 {
+		t.Errorf("unexpected first match: %+v", m)
+	}
+	if m := merged[1]; m.Id != 3 || len(m.Ids) != 1 {
+		t.Errorf("unexpected second match: %+v", m)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* rules disabled at runtime with POST /rules/{id}/disable, their matches are not reported */
+var disabledRules = newRuleSet()
+
+// set of rule ids, saved to path after each change when path is set
+type ruleSet struct {
+	sync.RWMutex
+	ids  map[int]bool
+	path string
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{ids: make(map[int]bool)}
+}
+
+func (s *ruleSet) Has(id int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ids[id]
+}
+
+// add or remove id, the set is saved when it changed. The change is made to a
+// copy swapped in once saved, a failed save leaves the set as it was.
+func (s *ruleSet) Set(id int, on bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.ids[id] == on {
+		return nil
+	}
+	ids := make(map[int]bool, len(s.ids)+1)
+	for i := range s.ids {
+		ids[i] = true
+	}
+	if on {
+		ids[id] = true
+	} else {
+		delete(ids, id)
+	}
+	if err := s.save(ids); err != nil {
+		return err
+	}
+	s.ids = ids
+	return nil
+}
+
+// sorted ids of the set
+func (s *ruleSet) List() []int {
+	s.RLock()
+	defer s.RUnlock()
+	ids := make([]int, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// load ids from path, one per line, and save changes back to it. A missing file is empty.
+func (s *ruleSet) Load(path string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.path = path
+	s.ids = make(map[int]bool)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid rule id %q", path, lineNo, line)
+		}
+		s.ids[id] = true
+	}
+	return scanner.Err()
+}
+
+// write ids to a temp file renamed over path, so a crash never leaves it half written
+func (s *ruleSet) save(ids map[int]bool) error {
+	if s.path == "" {
+		return nil
+	}
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	var buf bytes.Buffer
+	for _, id := range sorted {
+		fmt.Fprintf(&buf, "%d\n", id)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".disabled")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(buf.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"  /* structured logger lib */
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/* database modes, see --mode */
+const (
+	ModeBlock  = "block"
+	ModeStream = "stream"
+
+	/* scan all parts of a request in one call, see scanVector */
+	ModeVectored = "vectored"
+)
+
+/* stream mode feeds the database with chunks of this size */
+const streamChunkSize = 4096
+
+// engine is a compiled database together with its scratches and rules,
+// it is swapped as a whole when the rules are reloaded.
+type engine struct {
+	sync.RWMutex /* read locked by scans, write locked to release */
+	mode         string
+	db           hyperscan.Database
+	block        hyperscan.BlockDatabase    /* set in block mode */
+	stream       hyperscan.StreamDatabase   /* set in stream mode */
+	vectored     hyperscan.VectoredDatabase /* set in vectored mode */
+	scratches    *scratchPool
+	regexMap     map[int]RegexLine
+	released     bool
+	utf8         bool         /* some rule has the u flag, input must be valid UTF-8 */
+	allows       bool         /* some rule has action allow, the match limits are applied after suppressAllowed */
+	cache        *resultCache /* nil without --cache-size */
+
+	/* memory of the compiled rules in bytes, reported by /info, 0 if hyperscan failed to tell */
+	dbSize      int
+	scratchSize int /* of one scratch, the pool holds up to PoolSize */
+	streamSize  int /* of one open stream, stream mode only */
+
+	/* what the rules were built from, reported by /info */
+	filepaths []string
+	flag      string
+	builtAt   time.Time
+	buildTime time.Duration
+}
+
+// ask hyperscan how much memory the database and its scratch take
+func (e *engine) measure() {
+	var err error
+	if e.dbSize, err = e.db.Size(); err != nil {
+		log.Warn(fmt.Sprintf("database size: %s", err))
+	}
+	if e.scratchSize, err = e.scratches.proto.Size(); err != nil {
+		log.Warn(fmt.Sprintf("scratch size: %s", err))
+	}
+	if e.stream != nil {
+		if e.streamSize, err = e.stream.StreamSize(); err != nil {
+			log.Warn(fmt.Sprintf("stream size: %s", err))
+		}
+	}
+}
+
+/* benign request scanned after every build, see warmup */
+var warmupSample = []byte("GET /index.html?page=1&q=hello+world HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\n\r\n")
+
+// scan warmupSample once before e serves, so the first requests after a (re)load
+// don't pay for touching cold database and scratch pages
+func (e *engine) warmup() {
+	start := time.Now()
+	scratch, err := e.scratches.Get()
+	if err != nil {
+		log.Warn(fmt.Sprintf("warmup: %s", err))
+		return
+	}
+	defer e.scratches.Put(scratch)
+	err = e.scan(warmupSample, scratch, func(id uint, from, to uint64, flags uint, context interface{}) error {
+		return nil
+	}, nil)
+	if err != nil {
+		log.Warn(fmt.Sprintf("warmup scan: %s", err))
+		return
+	}
+	log.Info(fmt.Sprintf("warmup scan in %s", time.Since(start)))
+}
+
+// scan aborted by the event handler returning an error, e.g. with --first-match
+func isScanTerminated(err error) bool {
+	hsErr, ok := err.(hyperscan.HsError)
+	return ok && hsErr == hyperscan.ErrScanTerminated
+}
+
+// scan data in one go, or chunk by chunk in stream mode
+func (e *engine) scan(data []byte, scratch *hyperscan.Scratch, handler hyperscan.MatchHandler, context interface{}) error {
+	switch e.mode {
+	case ModeStream:
+		return e.scanReader(bytes.NewReader(data), scratch, handler, context)
+	case ModeVectored:
+		return e.vectored.Scan([][]byte{data}, scratch, handler, context)
+	}
+	return e.block.Scan(data, scratch, handler, context)
+}
+
+// scan inputs as one vector, match offsets are mapped back to the input the match ends in.
+// A match spanning inputs starts at 0 of its input, as matches without the l flag do.
+func (e *engine) scanVector(inputs [][]byte, scratch *hyperscan.Scratch, match func(i int, id uint, from, to uint64, flags uint) error) error {
+	ends := make([]uint64, len(inputs)) /* offset after each input in the vector */
+	var end uint64
+	for i, input := range inputs {
+		end += uint64(len(input))
+		ends[i] = end
+	}
+	handler := func(id uint, from, to uint64, flags uint, context interface{}) error {
+		i := sort.Search(len(ends), func(i int) bool { return ends[i] >= to })
+		if i >= len(ends) {
+			i = len(ends) - 1
+		}
+		start := ends[i] - uint64(len(inputs[i]))
+		if from < start {
+			from = start
+		}
+		return match(i, id, from-start, to-start, flags)
+	}
+	return e.vectored.Scan(inputs, scratch, handler, nil)
+}
+
+// scan everything read from r, only stream mode avoids buffering the whole input
+func (e *engine) scanReader(r io.Reader, scratch *hyperscan.Scratch, handler hyperscan.MatchHandler, context interface{}) error {
+	if e.mode != ModeStream {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return e.scan(data, scratch, handler, context)
+	}
+
+	stream, err := e.stream.Open(0, scratch, handler, context)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := stream.Scan(buf[:n]); err != nil {
+				stream.Close()
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.Close()
+			return err
+		}
+	}
+	/* matches at end of data are reported on close */
+	return stream.Close()
+}
+
+// currently serving engine of the --filepath rules
+func currentEngine() *engine {
+	return loadEngine(&Engine)
+}
+
+func loadEngine(v *atomic.Value) *engine {
+	e, _ := v.Load().(*engine)
+	return e
+}
+
+// pin the current engine for a scan, call done when finished.
+func acquireEngine() *engine {
+	return acquireFrom(&Engine)
+}
+
+// pin the engine held by v, see routeEngine
+func acquireFrom(v *atomic.Value) *engine {
+	for {
+		e := loadEngine(v)
+		e.RLock()
+		if !e.released {
+			return e
+		}
+		/* swapped and released meanwhile, retry with the new one */
+		e.RUnlock()
+	}
+}
+
+func (e *engine) done() {
+	e.RUnlock()
+}
+
+// release waits for running scans, then frees the database and scratches.
+func (e *engine) release() {
+	e.Lock()
+	defer e.Unlock()
+	e.released = true
+	e.scratches.Close()
+	e.db.Close()
+}
+
+// install e as the serving engine and release the previous one
+func swapEngine(e *engine) {
+	swapInto(&Engine, e)
+}
+
+func swapInto(v *atomic.Value, e *engine) {
+	old := loadEngine(v)
+	v.Store(e)
+	if old != nil {
+		go old.release()
+	}
+}
+
+// rebuild rules and reload the TLS certificate on SIGHUP,
+// the old rules and certificate keep serving if a reload fails
+func watchReload() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if TLSCert != "" {
+			if err := loadCertificate(); err != nil {
+				log.Error(fmt.Sprintf("reload certificate failed, keep serving old certificate: %s", err))
+			} else {
+				log.Info("reload certificate success")
+			}
+		}
+
+		log.Info("SIGHUP received, reloading rules")
+		reloadRules()
+	}
+}
+
+/* one rebuild at a time: SIGHUP waits for a running one, POST /reload is refused */
+var reloading = make(chan struct{}, 1)
+
+var errReloadInProgress = errors.New("reload already in progress")
+
+// rebuild rules from FilePaths and every ruleset, returns the new rule number of FilePaths.
+// Waits for a reload already running.
+func reloadRules() (int, error) {
+	reloading <- struct{}{}
+	defer func() { <-reloading }()
+	return rebuildRules()
+}
+
+// reloadRules, but fails with errReloadInProgress instead of waiting
+func tryReloadRules() (int, error) {
+	select {
+	case reloading <- struct{}{}:
+	default:
+		return 0, errReloadInProgress
+	}
+	defer func() { <-reloading }()
+	return rebuildRules()
+}
+
+func rebuildRules() (int, error) {
+	if err := buildScratch(FilePaths...); err != nil {
+		log.Error(fmt.Sprintf("reload rules failed, keep serving old rules: %s", err))
+		return 0, err
+	}
+	if err := buildRulesets(); err != nil {
+		log.Error(fmt.Sprintf("reload rules failed, keep serving old rules: %s", err))
+		return 0, err
+	}
+	n := len(currentEngine().regexMap)
+	log.Info(fmt.Sprintf("reload rules success, rule number: %d", n))
+	return n, nil
+}
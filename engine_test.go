@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/flier/gohs/hyperscan"
+	"github.com/valyala/fasthttp"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// test a failed reload keeps the serving rules
+func TestReloadKeepsOldEngine(t *testing.T) {
+	if err := buildScratch("patterns/pattern1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	old := currentEngine()
+
+	if err := buildScratch("patterns/not-exists.txt"); err == nil {
+		t.Error("expect error for missing file")
+	}
+	if currentEngine() != old {
+		t.Error("engine swapped by failed reload")
+	}
+
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	e := acquireEngine()
+	defer e.done()
+	if e == old {
+		t.Error("engine not swapped by reload")
+	}
+	if _, ok := e.regexMap[101]; !ok {
+		t.Error("rule 101 not loaded")
+	}
+}
+
+// test scans racing reloads always see the rules of the database they scanned with,
+// run with -race to also check the swap itself
+func TestConcurrentReload(t *testing.T) {
+	one := writeRules(t, "1\t<script\tone\n")
+	defer os.Remove(one)
+	two := writeRules(t, "2\t<script\ttwo\n")
+	defer os.Remove(two)
+	if err := buildScratch(one); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parts := []scanPart{{target: TargetURI, data: []byte("<script>")}}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				matchResps, err := scanParts(parts)
+				if err != nil || len(matchResps) != 1 {
+					t.Errorf("expect 1 match, got %v %+v", err, matchResps)
+					return
+				}
+				m := matchResps[0]
+				if expect := map[int]string{1: "one", 2: "two"}[m.Id]; m.RegexLinev.Data != expect {
+					t.Errorf("rule %d reported with data of another snapshot: %q", m.Id, m.RegexLinev.Data)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if err := buildScratch([]string{one, two}[i%2]); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// test POST /reload is refused while another reload runs
+func TestReloadInProgress(t *testing.T) {
+	reloading <- struct{}{}
+	ctx := doRequest(reloadHandler, "/reload", "")
+	<-reloading
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusConflict {
+		t.Errorf("expect 409 while reloading, got %d", code)
+	}
+	if body := string(ctx.Response.Body()); !strings.Contains(body, "reload already in progress") {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+// test a reload whose scratch allocation fails keeps the old rules matching
+func TestReloadScratchFailure(t *testing.T) {
+	FilePaths = []string{"patterns/xss.txt"}
+	defer func() { FilePaths = nil }()
+	if err := buildScratch(FilePaths...); err != nil {
+		t.Fatal(err)
+	}
+	old := currentEngine()
+
+	newScratch = func(hyperscan.Database) (*hyperscan.Scratch, error) {
+		return nil, errors.New("out of memory")
+	}
+	_, err := reloadRules()
+	newScratch = hyperscan.NewScratch
+	if err == nil {
+		t.Fatal("expect error for failed scratch allocation")
+	}
+	if currentEngine() != old {
+		t.Error("engine swapped by failed reload")
+	}
+	if matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); err != nil || len(matchResps) != 1 {
+		t.Errorf("expect old rules still matching, got %+v, %v", matchResps, err)
+	}
+
+	newScratch = func(hyperscan.Database) (*hyperscan.Scratch, error) {
+		panic("scratch")
+	}
+	_, err = reloadRules()
+	newScratch = hyperscan.NewScratch
+	if err == nil || currentEngine() != old {
+		t.Errorf("expect panic turned into error keeping old rules, got %v", err)
+	}
+}
+
+// test requests are scanned by the ruleset of the longest matching route
+func TestRoutes(t *testing.T) {
+	if err := buildScratch("patterns/pattern1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	Rulesets, err = parseRulesets([]string{"strict=patterns/xss.txt", "api=patterns/pattern1.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Routes, err = parseRoutes([]string{"/admin/=strict", "/admin/public/=api"}, Rulesets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Rulesets, Routes = nil, nil }()
+	if err := buildRulesets(); err != nil {
+		t.Fatal(err)
+	}
+
+	part := []scanPart{{target: TargetBody, data: []byte("<script>")}}
+	for path, expect := range map[string]int{"/admin/x": 1, "/admin/public/x": 0, "/api/x": 0} {
+		matchResps, err := scanPartsIn(routeEngine([]byte(path)), part)
+		if err != nil || len(matchResps) != expect {
+			t.Errorf("%s: expect %d matches, got %+v, %v", path, expect, matchResps, err)
+		}
+	}
+	if _, err := parseRoutes([]string{"/x=missing"}, Rulesets); err == nil {
+		t.Error("expect error for unknown ruleset")
+	}
+}
+
+// test stream mode reports the same rules as block mode
+func TestStreamMode(t *testing.T) {
+	Mode = ModeStream
+	defer func() { Mode = "" }()
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if m := currentEngine().mode; m != ModeStream {
+		t.Fatalf("expect stream engine, got %s", m)
+	}
+
+	/* payload crosses a chunk boundary */
+	data := make([]byte, streamChunkSize-3)
+	for i := range data {
+		data[i] = 'a'
+	}
+	data = append(data, []byte("<script>")...)
+	matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].Id != 101 {
+		t.Errorf("unexpected matches: %+v", matchResps)
+	}
+}
+
+// test --first-match stops after one match without error
+func TestFirstMatch(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	FirstMatch = true
+	defer func() { FirstMatch = false }()
+	matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script> onload=")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 {
+		t.Errorf("expect 1 match, got %+v", matchResps)
+	}
+}
+
+// test --once-per-id reports a rule firing repeatedly once, at its first match
+func TestOncePerID(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	parts := []scanPart{
+		{target: TargetURI, data: []byte("onload= onerror=")},
+		{target: TargetBody, data: []byte("<script> onerror=")},
+	}
+	matchResps, err := scanParts(parts)
+	if err != nil || len(matchResps) != 4 {
+		t.Fatalf("expect 4 matches, got %+v, %v", matchResps, err)
+	}
+
+	OncePerID = true
+	defer func() { OncePerID = false }()
+	matchResps, err = scanParts(parts)
+	if err != nil || len(matchResps) != 2 {
+		t.Fatalf("expect 2 matches, got %+v, %v", matchResps, err)
+	}
+	if m := matchResps[0]; m.Id != 102 || m.Target != TargetURI || m.To != 7 {
+		t.Errorf("expect the first match of 102 reported, got %+v", m)
+	}
+}
+
+// test a scan over --scan-timeout stops and is answered with 503
+func TestScanTimeout(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTimeout = time.Nanosecond
+	defer func() { ScanTimeout = 0 }()
+	if _, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); err != errScanTimeout {
+		t.Errorf("expect scan timeout, got %v", err)
+	}
+
+	ScanTargets = map[string]bool{TargetBody: true}
+	defer func() { ScanTargets = nil }()
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBodyString("<script>")
+	requestHandler(ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusServiceUnavailable || !strings.Contains(string(ctx.Response.Body()), `"errno":-6`) {
+		t.Errorf("expect 503 errno -6, got %d: %s", code, ctx.Response.Body())
+	}
+
+	ScanTimeout = time.Minute
+	if matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("<script>")}); err != nil || len(matchResps) != 1 {
+		t.Errorf("expect scan within timeout to match, got %+v, %v", matchResps, err)
+	}
+}
+
+// test vectored mode maps matches back to the part they end in
+func TestVectoredMode(t *testing.T) {
+	Mode = ModeVectored
+	defer func() { Mode = "" }()
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	parts := []scanPart{
+		{target: TargetURI, data: []byte("/?q=1")},
+		{target: TargetBody, data: []byte("a <script>")},
+	}
+	matchResps, err := scanParts(parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].Target != TargetBody || matchResps[0].To != 10 {
+		t.Errorf("unexpected matches: %+v", matchResps)
+	}
+
+	/* a payload split over parts still matches, in the part it ends in */
+	parts = []scanPart{
+		{target: TargetURI, data: []byte("/?q=<scr")},
+		{target: TargetBody, data: []byte("ipt>")},
+	}
+	matchResps, err = scanParts(parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].Target != TargetBody || matchResps[0].From != 0 || matchResps[0].To != 4 {
+		t.Errorf("unexpected matches: %+v", matchResps)
+	}
+}
+
+// test matches come back in offset order, the most severe first
+func TestMatchOrder(t *testing.T) {
+	path := writeRules(t, "1\tb\tdata\n2\ta\tdata\n3\tc\tdata\tiou\thigh\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	matchResps, err := scanParts([]scanPart{{target: TargetURI, data: []byte("xabc")}, {target: TargetBody, data: []byte("ba")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range matchResps {
+		got = append(got, fmt.Sprintf("%s:%d", m.Target, m.Id))
+	}
+	if strings.Join(got, " ") != "uri:3 uri:2 uri:1 body:1 body:2" {
+		t.Errorf("unexpected match order %v", got)
+	}
+}
+
+// test allow rules suppress the overlapping matches of other rules
+func TestAllowRules(t *testing.T) {
+	path := writeRules(t, "1\tadmin\tdata\til\n2\t/api/admin/health\tdata\til\tinfo\tallow\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	matchResps, err := scanParts([]scanPart{{target: TargetURI, data: []byte("/api/admin/health")}, {target: TargetBody, data: []byte("admin")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].Target != TargetBody || matchResps[0].Id != 1 {
+		t.Errorf("expect only the body match left, got %+v", matchResps)
+	}
+
+	noSom := writeRules(t, "1\t/health\tdata\ti\tinfo\tallow\n")
+	defer os.Remove(noSom)
+	if err := buildScratch(noSom); err == nil || !strings.Contains(err.Error(), "need the l flag") {
+		t.Errorf("expect allow rule without l rejected, got %v", err)
+	}
+}
+
+// test allow matches never use up --first-match, --max-matches or --once-per-id
+func TestAllowRulesLimits(t *testing.T) {
+	path := writeRules(t, "2\tsafe<script>\tdata\til\tinfo\tallow\n1\t<script\txss\til\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	part := scanPart{target: TargetBody, data: []byte("safe<script> then <script>")}
+
+	FirstMatch = true
+	matchResps, err := scanRequestPart(part)
+	FirstMatch = false
+	if err != nil || len(matchResps) != 1 || matchResps[0].Id != 1 || matchResps[0].From != 18 {
+		t.Errorf("first-match: expect the match outside the allowed text, got %v %+v", err, matchResps)
+	}
+
+	OncePerID = true
+	matchResps, err = scanRequestPart(part)
+	OncePerID = false
+	if err != nil || len(matchResps) != 1 || matchResps[0].From != 18 {
+		t.Errorf("once-per-id: expect the match outside the allowed text, got %v %+v", err, matchResps)
+	}
+
+	MaxMatches = 1
+	defer func() { MaxMatches = 0 }()
+	matchResps, err = scanRequestPart(part)
+	if err != nil || len(matchResps) != 1 || matchResps[0].From != 18 {
+		t.Errorf("max-matches: expect the match outside the allowed text, got %v %+v", err, matchResps)
+	}
+}
+
+// test --max-matches stops the scan and flags the cut
+func TestMaxMatches(t *testing.T) {
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	MaxMatches = 2
+	defer func() { MaxMatches = 0 }()
+	parts := []scanPart{{target: TargetBody, data: []byte(strings.Repeat("<script>", 5))}, {target: TargetURI, data: []byte("<script>")}}
+	matchResps, err := scanParts(parts)
+	if err != errMaxMatches || len(matchResps) != 2 {
+		t.Errorf("expect 2 matches and errMaxMatches, got %v %d", err, len(matchResps))
+	}
+	if matchResps, err := scanParts(parts[1:]); err != nil || len(matchResps) != 1 {
+		t.Errorf("expect no flag below the limit, got %v %d", err, len(matchResps))
+	}
+
+	ScanTargets = map[string]bool{TargetBody: true}
+	defer func() { ScanTargets = nil }()
+	ctx := doRequest(requestHandler, "/", strings.Repeat("<script>", 5))
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"matches_truncated":true`) {
+		t.Errorf("expect matches_truncated in response, got %s", body)
+	}
+}
+
+// test --skip-empty-matches drops the zero length matches of an empty matchable rule
+func TestSkipEmptyMatches(t *testing.T) {
+	path := writeRules(t, "1\tx*\tsloppy\tel\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if warnings := currentEngine().regexMap[1].Warnings; len(warnings) == 0 || !strings.Contains(warnings[0], "empty string") {
+		t.Errorf("expect an empty string warning, got %q", warnings)
+	}
+
+	part := scanPart{target: "body", data: []byte("axxb")}
+	matchResps, err := scanRequestPart(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasEmptyMatch(matchResps) {
+		t.Fatalf("expect empty matches without the flag, got %+v", matchResps)
+	}
+	SkipEmptyMatches = true
+	defer func() { SkipEmptyMatches = false }()
+	matchResps, err = scanRequestPart(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* hyperscan reports every end offset, "x" as well as "xx", so only emptiness is checked */
+	if len(matchResps) == 0 || hasEmptyMatch(matchResps) {
+		t.Errorf("expect only non empty matches, got %+v", matchResps)
+	}
+}
+
+func hasEmptyMatch(matchResps []MatchResp) bool {
+	for _, m := range matchResps {
+		if m.From == m.To {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+/* json value parts are marked with this in MatchResp.Decoded */
+const EncodingJSON = "json"
+
+/* object keys written as .key in json paths, others as ["key"] */
+var jsonIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// every string value of a json body as its own part, labelled with its path like
+// $.user.name or $.items[0]. false when not enabled, not json or not parsable, the
+// raw body is scanned then.
+func jsonParts(ctx *fasthttp.RequestCtx) ([]scanPart, bool) {
+	if !ScanJSON || !isJSONContentType(ctx.Request.Header.ContentType()) {
+		return nil, false
+	}
+	body := ctx.PostBody()
+	/* the raw body is cut to --max-body-bytes, a cut document would not parse */
+	if MaxBodyBytes > 0 && len(body) > MaxBodyBytes {
+		return nil, false
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		log.Debug(fmt.Sprintf("parse json body: %s, scan raw body", err))
+		return nil, false
+	}
+
+	var parts []scanPart
+	walkJSON(doc, "$", func(path string, value string) {
+		if value != "" {
+			parts = append(parts, scanPart{target: TargetBody, data: []byte(value), label: path + "=", decoded: EncodingJSON, location: "json:" + path})
+		}
+	})
+	return parts, true
+}
+
+// application/json and the +json types like application/problem+json
+func isJSONContentType(contentType []byte) bool {
+	if i := bytes.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = bytes.ToLower(bytes.TrimSpace(contentType))
+	return bytes.Equal(contentType, []byte("application/json")) || bytes.HasSuffix(contentType, []byte("+json"))
+}
+
+// call visit with the path of every string in v, object keys in sorted order
+func walkJSON(v interface{}, path string, visit func(path string, value string)) {
+	switch v := v.(type) {
+	case string:
+		visit(path, v)
+	case []interface{}:
+		for i, item := range v {
+			walkJSON(item, path+"["+strconv.Itoa(i)+"]", visit)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if jsonIdent.MatchString(key) {
+				walkJSON(v[key], path+"."+key, visit)
+			} else {
+				quoted, _ := json.Marshal(key)
+				walkJSON(v[key], path+"["+string(quoted)+"]", visit)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"  /* structured logger lib */
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* severities of a lint finding, errors fail the load, warnings are rules that load but likely misbehave */
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+/* one problem found by the lint command */
+type LintFinding struct {
+	Pos      string /* path:line or path: rule n */
+	Severity string
+	Msg      string
+}
+
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Pos, f.Severity, f.Msg)
+}
+
+var ruleIdRe = regexp.MustCompile(`\d+`)
+
+// lint reports problems of the --filepath rules by line, the load warnings
+// included, and fails on errors, or on warnings too with --strict
+func lint(cmd *cobra.Command, args []string) error {
+	/* the findings replace the load logs */
+	if !Debug {
+		log.SetLevel(log.ErrorLevel)
+	}
+	paths, err := expandRulePaths(FilePaths)
+	if err != nil {
+		return err
+	}
+	flags, err := parseCompileFlag(Flag)
+	if err != nil {
+		return err
+	}
+	findings, err := lintRules(paths, flags)
+	if err != nil {
+		return err
+	}
+
+	errs, warns := 0, 0
+	for _, f := range findings {
+		fmt.Println(f)
+		if f.Severity == LintError {
+			errs++
+		} else {
+			warns++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings in %d files\n", errs, warns, len(paths))
+	if errs > 0 || warns > 0 && viper.GetBool("lint.strict") {
+		return fmt.Errorf("lint failed")
+	}
+	return nil
+}
+
+// findings of the rules of paths, checked one by one so a bad line doesn't hide
+// the next; the error is for a file which can't be read at all
+func lintRules(paths []string, flags hyperscan.CompileFlag) ([]LintFinding, error) {
+	var findings []LintFinding
+	add := func(pos, severity, msg string) {
+		findings = append(findings, LintFinding{Pos: pos, Severity: severity, Msg: strings.TrimPrefix(msg, pos+": ")})
+	}
+	defined := make(map[int]string) /* rule id => pos which defines it */
+	quiet := make(map[int]string)   /* quiet rule id => pos, checked against the combinations */
+	combined := make(map[int]bool)  /* ids used in a combination */
+	autoIds := 0                    /* numbered as on load, see visitRuleFile */
+
+	for _, path := range paths {
+		visit := func(pos string, spec ruleSpec, err error) error {
+			if err != nil {
+				add(pos, LintError, err.Error())
+				return nil
+			}
+			pattern, regexLine, err := newRule(pos, spec, flags)
+			if err != nil {
+				add(pos, LintError, err.Error())
+				return nil
+			}
+			if first, ok := defined[*spec.Id]; ok {
+				add(pos, LintError, fmt.Sprintf("regex id %d is already defined at %s", *spec.Id, first))
+				return nil
+			}
+			defined[*spec.Id] = pos
+			for _, w := range regexLine.Warnings {
+				add(pos, LintWarning, fmt.Sprintf("regex id %d: %s", *spec.Id, w))
+			}
+
+			switch {
+			case pattern.Flags&Combination != 0:
+				for _, s := range ruleIdRe.FindAllString(regexLine.Expr, -1) {
+					id, _ := strconv.Atoi(s)
+					combined[id] = true
+				}
+			case pattern.Flags&Quiet != 0:
+				quiet[*spec.Id] = pos
+			default:
+				/* a rule firing on an ordinary request blocks everything */
+				matchResps, err := scanOnce(pattern, regexLine, warmupSample)
+				if err != nil {
+					add(pos, LintError, fmt.Sprintf("regex id %d: %s", *spec.Id, err))
+				} else if len(matchResps) > 0 {
+					add(pos, LintWarning, fmt.Sprintf("regex id %d matches a benign request ending at offset %d, likely too broad", *spec.Id, matchResps[0].To))
+				}
+			}
+			return nil
+		}
+		skip := func(pos, line, reason string) {
+			/* a comment is meant to be skipped */
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				add(pos, LintWarning, fmt.Sprintf("skipped, %s", reason))
+			}
+		}
+		if err := visitRuleFile(path, &autoIds, visit, skip); err != nil {
+			return nil, err
+		}
+	}
+
+	var unused []int
+	for id := range quiet {
+		if !combined[id] {
+			unused = append(unused, id)
+		}
+	}
+	sort.Ints(unused)
+	for _, id := range unused {
+		add(quiet[id], LintWarning, fmt.Sprintf("quiet regex id %d is in no combination, it never reports", id))
+	}
+	if len(defined) == 0 {
+		add(strings.Join(paths, ", "), LintError, "no rules")
+	}
+	return findings, nil
+}
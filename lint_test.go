@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// test lint reports each problem at its line and keeps going
+func TestLintRules(t *testing.T) {
+	path := writeRules(t, "# comment\n"+
+		"1\t<script\txss\n"+
+		"1\tonload\tdup\n"+
+		"2\t(unclosed\tbad\n"+
+		"3\tMozilla\tbroad\n"+
+		"short\n"+
+		"4\tabc\tbad flag\tZ\n"+
+		"5\tevil\tpart\tq\n")
+	defer os.Remove(path)
+
+	findings, err := lintRules([]string{path}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, f := range findings {
+		got[strings.TrimPrefix(f.Pos, path)] += f.Severity + " " + f.Msg + "|"
+	}
+	for pos, want := range map[string]string{
+		":3": "error regex id 1 is already defined",
+		":4": "error invalid regex",
+		":5": "warning regex id 3 matches a benign request",
+		":6": "warning skipped",
+		":7": "error regex id 4: unknown flag",
+		":8": "warning quiet regex id 5 is in no combination",
+	} {
+		if !strings.HasPrefix(got[pos], want) {
+			t.Errorf("%s: got %q, want %q", pos, got[pos], want)
+		}
+	}
+	if _, ok := got[":1"]; ok {
+		t.Errorf("comment reported: %q", got[":1"])
+	}
+	if _, ok := got[":2"]; ok {
+		t.Errorf("good rule reported: %q", got[":2"])
+	}
+}
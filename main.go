@@ -1,281 +1,1410 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
-	log "github.com/Sirupsen/logrus"  /* structured logger lib */
-	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
-	"github.com/spf13/cobra"          /* CLI lib */
-	"github.com/spf13/viper"          /* Configuration lib */
-	"github.com/valyala/fasthttp"     /* http parse lib */
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/spf13/cobra"         /* CLI lib */
+	"github.com/spf13/pflag"         /* CLI flags lib */
+	"github.com/spf13/viper"         /* Configuration lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"math"
+	"net"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
-// with sync for resource lock
-type scratch struct {
-	sync.RWMutex
-	s *hyperscan.Scratch
-}
+/* what to do with input over --max-scan-bytes */
+const (
+	OversizeTruncate = "truncate"
+	OversizeReject   = "reject"
+)
+
+/* what to do with invalid UTF-8 input when rules are compiled with the u flag */
+const (
+	InvalidUTF8Reject   = "reject"
+	InvalidUTF8Sanitize = "sanitize"
+)
+
+/* scan result bodies, see --response */
+const (
+	ResponseFull    = "full"
+	ResponseMinimal = "minimal"
+)
+
+/* answer to requests whose scan failed, see --on-error */
+const (
+	OnErrorOpen   = "open"   /* let the request through */
+	OnErrorClosed = "closed" /* block it as if a rule matched */
+)
+
+/* request parts which can be scanned, see --scan-targets */
+const (
+	TargetURI     = "uri"
+	TargetBody    = "body"
+	TargetHeaders = "headers"
+	TargetCookies = "cookies" /* every cookie value on its own, see --scan-cookies */
+
+	/* the method, the protocol and the whole request line, see --scan-request-line */
+	TargetRequestLine = "request_line"
+)
 
 var (
-	Version string
-	Debug   bool
-	Port    int
-	Flag    string
-	Uptime  time.Time
+	Version            string /* build info, set with -ldflags "-X main.Version=..." */
+	GitCommit          string
+	BuildDate          string
+	Debug              bool
+	QuietLog           bool /* diagnostic log at warn level, see --quiet */
+	Host               string
+	Port               int
+	Flag               string
+	Mode               string
+	DbCache            string /* compiled block mode database is cached here, see --db-cache */
+	AdminToken         string
+	ContentType        string /* of every json response, see writeJSON */
+	SkipInvalid        bool
+	Anchor             bool /* anchor rules whose data has "anchor": true, see anchorExpr */
+	MaxExprLen         int  /* longer expressions are rejected, 0 is no limit */
+	TLSCert            string
+	TLSKey             string
+	Uptime             time.Time
+	ScanTargets        map[string]bool
+	ScanArgs           bool /* scan the path and each query arg value instead of the raw uri */
+	ScanMultipart      bool /* scan multipart/form-data fields instead of the raw body */
+	ScanJSON           bool /* scan the string values of json bodies instead of the raw body */
+	MultipartFileBytes int  /* bytes scanned of each uploaded file, 0 skips files */
+	Normalize          map[string]bool
+	HeaderInclude      map[string]bool
+	HeaderExclude      map[string]bool
+	MaxBodyBytes       int
+	MaxScanBytes       int
+	Oversize           string
+	PoolSize           int
+	CacheSize          int /* entries of the per engine result cache, 0 is off */
+	Block              bool
+	Dedup              bool
+	FirstMatch         bool
+	SkipEmptyMatches   bool
+	OncePerID          bool /* report every rule at most once per scan */
+	ResponseMode       string
+	OnError            string
+	ScanTimeout        time.Duration
+	MaxMatches         int /* 0 is unlimited */
+	ShutdownTimeout    time.Duration
+	ReadTimeout        time.Duration /* connection timeouts and limits of the server, 0 is unlimited */
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	MaxConnsPerIP      int
+	DecodeBody         bool
+	MaxDecodedBytes    int
+	RateLimit          float64
+	RateBurst          int
+	MaxConcurrency     int
+	DisabledRulesFile  string
+	DecodeBase64       bool
+	Base64MinLen       int
+	InvalidUTF8        string
+	ContextWindow      int
+	RulesTimeout       time.Duration
+	RulesHeaders       []string
+	QueueTimeout       time.Duration
 
 	/* TODO: 以下元素需要封装成对象，每个参数一个对象 */
-	/* TODO: 目前只能读一个文件 ? */
-	FilePath string
-	Scratch  scratch
-	Db       hyperscan.BlockDatabase
-	RegexMap map[int]RegexLine
+	FilePaths []string
+	Engine    atomic.Value /* *engine, swapped on reload */
 )
 
 /* not match resp */
 type Response struct {
-	Errno int         `json:errno`
-	Msg   string      `json:msg`
-	Data  interface{} `json:data`
+	Errno            int         `json:"errno"`
+	Msg              string      `json:"msg,omitempty"`
+	Data             interface{} `json:"data,omitempty"`
+	Truncated        bool        `json:"truncated,omitempty"`         /* scan input was cut to --max-scan-bytes */
+	Reason           string      `json:"reason,omitempty"`            /* data of the rule a request is blocked for */
+	MatchesTruncated bool        `json:"matches_truncated,omitempty"` /* more matches than --max-matches, the rest is left out */
+	RequestID        string      `json:"request_id,omitempty"`        /* X-Request-ID of the request, generated when missing */
 }
 
 /* match resp */
 type MatchResp struct {
-	Id         int       `json:id`
-	From       int       `json:from`
-	To         int       `json:to`
-	Flags      int       `json:flags`
-	Context    string    `json:context`
-	RegexLinev RegexLine `json:regexline`
+	Id         int       `json:"id"`
+	From       int       `json:"from"`
+	To         int       `json:"to"`
+	Flags      int       `json:"flags"`
+	Context    string    `json:"context"` /* snippet of the scanned input around the match */
+	RegexLinev RegexLine `json:"regexline"`
+	Target     string    `json:"target"`
+	Location   string    `json:"location"`             /* part of the target scanned, e.g. "uri", "header:User-Agent", "arg:q" */
+	Normalized bool      `json:"normalized,omitempty"` /* the scanned input was normalized, From/To refer to it, Matched and Context to the data sent */
+	Ids        []int     `json:"ids,omitempty"`        /* rules merged into this match by --dedup */
+	Matched    string    `json:"matched"`              /* input[From:To], From is 0 unless the rule has the l flag */
+	Decoded    string    `json:"decoded,omitempty"`    /* encodings the data was decoded from by --decode-body or --decode-base64 */
 }
 
 type RegexLine struct {
-	Expr string
-	Data string
+	Expr     string `json:"expr"`
+	Data     string `json:"data"`
+	Flags    string `json:"flags"`    /* effective compile flags */
+	Severity string `json:"severity"` /* info, low, medium, high or critical */
+	Action   string `json:"action"`   /* block, log or challenge */
+	Category string `json:"category,omitempty"`
+	Ext      string `json:"ext,omitempty"` /* extended parameters, e.g. min_offset=10 */
+
+	Warnings []string `json:"-"` /* load time diagnostics, see GET /rules/warnings */
 }
 
 func main() {
-	Version = "0.0.1"
-	viper.AutomaticEnv()
+	if Version == "" {
+		Version = "0.0.1"
+	}
+	if GitCommit == "" {
+		GitCommit = "unknown"
+	}
+	if BuildDate == "" {
+		BuildDate = "unknown"
+	}
+	initEnv()
 	var rootCmd = &cobra.Command{
 		Use:     "hwaf",
 		Short:   fmt.Sprintf("Gohs-ladon Service %s", Version),
 		Run:     run,
 		PreRunE: preRunE,
 	}
-	rootCmd.Flags().Bool("debug", false, "Enable debug mode")
+	var validateCmd = &cobra.Command{
+		Use:     "validate",
+		Short:   "Compile the rule files and exit without starting the server",
+		Args:    cobra.NoArgs,
+		PreRunE: initRules,
+		/* a broken rule file is not a usage error */
+		SilenceUsage: true,
+		RunE:         validate,
+	}
+	var scanCmd = &cobra.Command{
+		Use:     "scan",
+		Short:   "Scan stdin or --input offline and print the matches as json",
+		Args:    cobra.NoArgs,
+		PreRunE: initRules,
+		RunE:    scan,
+	}
+	scanCmd.Flags().String("input", "", "File to scan instead of stdin")
+	bindSubcommandFlag("scan.input", scanCmd.Flags().Lookup("input"))
+	var benchCmd = &cobra.Command{
+		Use:          "bench",
+		Short:        "Scan a sample repeatedly and report throughput and latency",
+		Args:         cobra.NoArgs,
+		PreRunE:      initRules,
+		RunE:         bench,
+		SilenceUsage: true,
+	}
+	benchCmd.Flags().String("input", "", "Sample file to scan instead of stdin")
+	benchCmd.Flags().Duration("duration", 10*time.Second, "How long to run")
+	benchCmd.Flags().Int("concurrency", 0, "Concurrent scanners (default GOMAXPROCS)")
+	bindSubcommandFlag("bench.input", benchCmd.Flags().Lookup("input"))
+	bindSubcommandFlag("bench.duration", benchCmd.Flags().Lookup("duration"))
+	bindSubcommandFlag("bench.concurrency", benchCmd.Flags().Lookup("concurrency"))
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Print the configuration in effect, merged from flags, env and --config, with secrets redacted",
+		Args:  cobra.NoArgs,
+		RunE:  dumpConfig,
+	}
+	configCmd.Flags().String("format", "json", "Output format, json or yaml")
+	bindSubcommandFlag("dump.format", configCmd.Flags().Lookup("format"))
+	var lintCmd = &cobra.Command{
+		Use:          "lint",
+		Short:        "Report problems of the rule files by line, for a pre-commit check",
+		Args:         cobra.NoArgs,
+		PreRunE:      initRules,
+		RunE:         lint,
+		SilenceUsage: true,
+	}
+	lintCmd.Flags().Bool("strict", false, "Fail on warnings too")
+	bindSubcommandFlag("lint.strict", lintCmd.Flags().Lookup("strict"))
+	rootCmd.AddCommand(validateCmd, scanCmd, benchCmd, configCmd, lintCmd)
+	rootCmd.PersistentFlags().String("config", "", "Config file (yaml, json, toml...), flags override it and it overrides env")
+	rootCmd.PersistentFlags().Bool("debug", false, "Enable debug mode")
+	rootCmd.PersistentFlags().Bool("quiet", false, "Only log warnings, errors and the access log line per request")
+	rootCmd.PersistentFlags().String("log-format", "text", "Log format, text or json")
+	rootCmd.Flags().String("host", "0.0.0.0", "Listen address")
 	rootCmd.Flags().Int("port", 8080, "Listen port")
-	rootCmd.Flags().String("filepath", "", "Dict file path")
-	rootCmd.Flags().String("flag", "iou", "Regex Flag")
+	rootCmd.PersistentFlags().StringSlice("filepath", nil, "Dict file path or http(s) url, comma separated or repeated for multiple files")
+	rootCmd.PersistentFlags().Duration("rules-timeout", 10*time.Second, "Timeout fetching an http(s) --filepath")
+	rootCmd.PersistentFlags().StringSlice("rules-header", nil, "Header sent fetching an http(s) --filepath, e.g. \"Authorization: Bearer xxx\"")
+	rootCmd.PersistentFlags().String("flag", "iou", "Regex Flag")
+	rootCmd.PersistentFlags().Bool("skip-invalid", false, "Skip invalid regex lines instead of failing the load")
+	rootCmd.PersistentFlags().Int("max-expr-len", 0, "Reject rule expressions longer than this, 0 is no limit")
+	rootCmd.PersistentFlags().Bool("anchor", false, "Anchor rules whose data has \"anchor\": true to the start of the input")
+	rootCmd.PersistentFlags().String("mode", ModeBlock, "Database mode, block, stream or vectored (all request parts in one scan)")
+	rootCmd.PersistentFlags().String("db-cache", "", "Cache the compiled block mode database in this file and load it on startup while the rules are unchanged")
+	rootCmd.Flags().String("scan-targets", "uri,body", "Comma separated request parts to scan (uri, body, headers, cookies, request_line)")
+	rootCmd.Flags().Bool("scan-headers", false, "Scan every request header value, same as adding headers to --scan-targets")
+	rootCmd.Flags().Bool("scan-json", false, "Scan only the string values of a json body, each labelled with its json path, instead of the raw body")
+	rootCmd.Flags().Bool("scan-multipart", false, "Scan each multipart/form-data field value separately instead of the raw body")
+	rootCmd.Flags().Int("multipart-file-bytes", 0, "With --scan-multipart also scan up to this many bytes of every uploaded file, 0 skips files")
+	rootCmd.Flags().Bool("scan-cookies", false, "Scan every cookie value separately, same as adding cookies to --scan-targets")
+	rootCmd.Flags().Bool("scan-request-line", false, "Scan the method, the protocol and the whole request line, same as adding request_line to --scan-targets")
+	rootCmd.Flags().Bool("scan-args", false, "Scan the uri path and each query arg value separately instead of the raw uri")
+	rootCmd.Flags().StringSlice("header-include", nil, "Only scan these headers")
+	rootCmd.Flags().StringSlice("header-exclude", nil, "Never scan these headers")
+	rootCmd.Flags().Bool("decode-base64", false, "Also scan what long base64 runs of the input decode to, when it looks like text")
+	rootCmd.Flags().Int("base64-min-len", 16, "Min length of a base64 run decoded by --decode-base64")
+	rootCmd.Flags().String("normalize", "", "Comma separated normalizations before scanning (url, double-url, lowercase)")
+	rootCmd.Flags().Int("max-body-bytes", 1<<20, "Max bytes of request body to scan, 0 means no limit")
+	rootCmd.Flags().Bool("decode-body", false, "Decompress gzip or deflate request body by Content-Encoding before scanning")
+	rootCmd.Flags().Int("max-decoded-bytes", 10<<20, "Max bytes decompressed from a request body, the rest is not scanned, 0 means no limit")
+	rootCmd.Flags().Bool("dedup", false, "Merge overlapping matches of a request part, without the l flag all matches of a part start at 0 and merge")
+	rootCmd.Flags().Bool("first-match", false, "Stop scanning a request at the first match")
+	rootCmd.Flags().Bool("skip-empty-matches", false, "Drop zero length matches (from == to) of rules which can match the empty string")
+	rootCmd.Flags().Duration("scan-timeout", 0, "Stop a scan running longer and answer 503 with the matches so far, 0 is off")
+	rootCmd.Flags().Int("max-matches", 0, "Stop a scan after this many matches and flag the response matches_truncated, 0 is unlimited")
+	rootCmd.Flags().Bool("once-per-id", false, "Report each rule at most once per request, at its first match")
+	rootCmd.Flags().StringSlice("allow-ips", nil, "Client ips or CIDRs whose requests are not scanned")
+	rootCmd.Flags().StringSlice("allow-paths", nil, "Path prefixes whose requests are not scanned")
+	rootCmd.Flags().String("content-type", "application/json", "Content-Type of json responses, e.g. \"application/json; charset=utf-8\"")
+	rootCmd.Flags().StringSlice("trusted-proxies", nil, "Proxy ips or CIDRs whose X-Forwarded-For and X-Real-IP name the client, off when empty")
+	rootCmd.Flags().StringSlice("cors-origin", nil, "Origins allowed to call the json api from a browser, * for any, off when empty")
+	rootCmd.Flags().String("admin-token", "", "Bearer token for admin api, only localhost is allowed when empty")
+	rootCmd.Flags().String("on-error", OnErrorClosed, "When a scan fails, open lets the request through with 200, closed blocks it with 403")
+	rootCmd.Flags().Int("breaker-threshold", 0, "Stop scanning for --breaker-cooldown after this many consecutive scan errors, answering per --on-error, 0 disables")
+	rootCmd.Flags().Duration("breaker-cooldown", 30*time.Second, "How long scanning stays disabled before it is retried")
+	rootCmd.Flags().String("response", ResponseFull, "Scan result body, full with every match or minimal with only {\"block\":true,\"rule\":id}")
+	rootCmd.Flags().Bool("block", true, "Respond 403 on match, false for detection only mode")
+	rootCmd.Flags().String("block-template", "", "Html/template file answering blocked requests instead of json, see BlockPage for its fields")
+	rootCmd.Flags().String("block-content-type", "text/html; charset=utf-8", "Content-Type of the --block-template page")
+	rootCmd.Flags().Bool("block-reason-header", false, "Also send the block reason, the data of the matched rule, in an X-WAF-Block-Reason header")
+	rootCmd.Flags().String("access-log", "", "Write access log entries as json to this file instead of the diagnostic log")
+	rootCmd.Flags().Int("access-log-max-size", 100, "Rotate --access-log at this many MB, 0 is no size limit")
+	rootCmd.Flags().Duration("access-log-rotate", 24*time.Hour, "Rotate --access-log this often, 0 is no time based rotation")
+	rootCmd.Flags().Int("access-log-max-backups", 7, "Rotated access logs kept, 0 keeps all")
+	rootCmd.Flags().String("webhook-url", "", "POST matches of each request as json to this url, asynchronously, off when empty")
+	rootCmd.Flags().String("webhook-severity", "", "Lowest severity of a match sent to --webhook-url, e.g. high, every match when empty")
+	rootCmd.Flags().Int("webhook-queue", 1000, "Events waiting for --webhook-url, more are dropped so alerting never slows scanning")
+	rootCmd.Flags().Duration("webhook-timeout", 5*time.Second, "Timeout of one --webhook-url post")
+	rootCmd.Flags().String("pprof", "", "Serve net/http/pprof on this admin address, e.g. localhost:6060, off when empty")
+	rootCmd.Flags().String("tls-cert", "", "TLS certificate file, serve HTTPS together with --tls-key")
+	rootCmd.Flags().String("tls-key", "", "TLS private key file")
+	rootCmd.Flags().Duration("shutdown-timeout", 10*time.Second, "Max time to drain active requests on SIGINT/SIGTERM")
+	rootCmd.Flags().Duration("read-timeout", 0, "Max time to read a whole request including the body, 0 is unlimited")
+	rootCmd.Flags().Duration("write-timeout", 0, "Max time to write a response, 0 is unlimited")
+	rootCmd.Flags().Duration("idle-timeout", 0, "Max time a keep-alive connection waits for the next request, 0 uses --read-timeout")
+	rootCmd.Flags().Int("max-conns-per-ip", 0, "Max concurrent connections per client ip, 0 is unlimited")
+	rootCmd.Flags().Int("max-scan-bytes", 0, "Max bytes scanned per request over all parts, 0 means no limit")
+	rootCmd.Flags().String("invalid-utf8", InvalidUTF8Reject, "Invalid UTF-8 input with u flag rules: reject with 400, or sanitize to U+FFFD and scan")
+	rootCmd.Flags().String("oversize", OversizeTruncate, "Input over --max-scan-bytes: truncate and scan, or reject with 413")
+	rootCmd.Flags().Float64("rate-limit", 0, "Max requests per second of a client ip, over it is rejected with 429, 0 means no limit")
+	rootCmd.Flags().Int("rate-burst", 0, "Requests a client ip may burst over --rate-limit (default the rate rounded up)")
+	rootCmd.Flags().Int("max-concurrency", 0, "Max scans running at once, excess requests queue (default GOMAXPROCS)")
+	rootCmd.Flags().Duration("queue-timeout", time.Second, "Max time a request queues for --max-concurrency before 503, 0 rejects at once")
+	rootCmd.Flags().StringSlice("ruleset", nil, "Named ruleset as name=file, repeat to add files, see --route")
+	rootCmd.Flags().StringSlice("route", nil, "Scan requests under a path prefix with a ruleset, e.g. /admin/=strict, others use --filepath")
+	rootCmd.Flags().Int("cache-size", 0, "Cache the matches of up to this many repeated inputs (<= 4KB each), emptied on reload, 0 is off, not used in vectored mode")
+	rootCmd.Flags().String("disabled-rules-file", "", "File keeping the rule ids disabled by the api, loaded at start and saved on change")
+	rootCmd.PersistentFlags().Int("context-window", 32, "Bytes of scanned input around a match kept as its context")
+	rootCmd.PersistentFlags().Int("scratch-pool-size", 0, "Max scratch spaces for concurrent scans (default GOMAXPROCS)")
 
-	viper.BindPFlag("debug", rootCmd.Flags().Lookup("debug"))
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
+	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
+	viper.BindPFlag("quiet", rootCmd.PersistentFlags().Lookup("quiet"))
+	viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
+	viper.BindPFlag("host", rootCmd.Flags().Lookup("host"))
 	viper.BindPFlag("port", rootCmd.Flags().Lookup("port"))
-	viper.BindPFlag("filepath", rootCmd.Flags().Lookup("filepath")) /* every arg is a file */
-	viper.BindPFlag("flag", rootCmd.Flags().Lookup("flag"))
+	viper.BindPFlag("filepath", rootCmd.PersistentFlags().Lookup("filepath")) /* every arg is a file */
+	viper.BindPFlag("rules-timeout", rootCmd.PersistentFlags().Lookup("rules-timeout"))
+	viper.BindPFlag("rules-header", rootCmd.PersistentFlags().Lookup("rules-header"))
+	viper.BindPFlag("flag", rootCmd.PersistentFlags().Lookup("flag"))
+	viper.BindPFlag("skip-invalid", rootCmd.PersistentFlags().Lookup("skip-invalid"))
+	viper.BindPFlag("max-expr-len", rootCmd.PersistentFlags().Lookup("max-expr-len"))
+	viper.BindPFlag("anchor", rootCmd.PersistentFlags().Lookup("anchor"))
+	viper.BindPFlag("mode", rootCmd.PersistentFlags().Lookup("mode"))
+	viper.BindPFlag("db-cache", rootCmd.PersistentFlags().Lookup("db-cache"))
+	viper.BindPFlag("scan-targets", rootCmd.Flags().Lookup("scan-targets"))
+	viper.BindPFlag("scan-headers", rootCmd.Flags().Lookup("scan-headers"))
+	viper.BindPFlag("scan-multipart", rootCmd.Flags().Lookup("scan-multipart"))
+	viper.BindPFlag("scan-json", rootCmd.Flags().Lookup("scan-json"))
+	viper.BindPFlag("multipart-file-bytes", rootCmd.Flags().Lookup("multipart-file-bytes"))
+	viper.BindPFlag("scan-cookies", rootCmd.Flags().Lookup("scan-cookies"))
+	viper.BindPFlag("scan-request-line", rootCmd.Flags().Lookup("scan-request-line"))
+	viper.BindPFlag("scan-args", rootCmd.Flags().Lookup("scan-args"))
+	viper.BindPFlag("header-include", rootCmd.Flags().Lookup("header-include"))
+	viper.BindPFlag("header-exclude", rootCmd.Flags().Lookup("header-exclude"))
+	viper.BindPFlag("decode-base64", rootCmd.Flags().Lookup("decode-base64"))
+	viper.BindPFlag("base64-min-len", rootCmd.Flags().Lookup("base64-min-len"))
+	viper.BindPFlag("normalize", rootCmd.Flags().Lookup("normalize"))
+	viper.BindPFlag("max-body-bytes", rootCmd.Flags().Lookup("max-body-bytes"))
+	viper.BindPFlag("decode-body", rootCmd.Flags().Lookup("decode-body"))
+	viper.BindPFlag("max-decoded-bytes", rootCmd.Flags().Lookup("max-decoded-bytes"))
+	viper.BindPFlag("dedup", rootCmd.Flags().Lookup("dedup"))
+	viper.BindPFlag("first-match", rootCmd.Flags().Lookup("first-match"))
+	viper.BindPFlag("skip-empty-matches", rootCmd.Flags().Lookup("skip-empty-matches"))
+	viper.BindPFlag("scan-timeout", rootCmd.Flags().Lookup("scan-timeout"))
+	viper.BindPFlag("max-matches", rootCmd.Flags().Lookup("max-matches"))
+	viper.BindPFlag("once-per-id", rootCmd.Flags().Lookup("once-per-id"))
+	viper.BindPFlag("allow-ips", rootCmd.Flags().Lookup("allow-ips"))
+	viper.BindPFlag("allow-paths", rootCmd.Flags().Lookup("allow-paths"))
+	viper.BindPFlag("content-type", rootCmd.Flags().Lookup("content-type"))
+	viper.BindPFlag("trusted-proxies", rootCmd.Flags().Lookup("trusted-proxies"))
+	viper.BindPFlag("cors-origin", rootCmd.Flags().Lookup("cors-origin"))
+	viper.BindPFlag("admin-token", rootCmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("block", rootCmd.Flags().Lookup("block"))
+	viper.BindPFlag("response", rootCmd.Flags().Lookup("response"))
+	viper.BindPFlag("on-error", rootCmd.Flags().Lookup("on-error"))
+	viper.BindPFlag("breaker-threshold", rootCmd.Flags().Lookup("breaker-threshold"))
+	viper.BindPFlag("breaker-cooldown", rootCmd.Flags().Lookup("breaker-cooldown"))
+	viper.BindPFlag("block-template", rootCmd.Flags().Lookup("block-template"))
+	viper.BindPFlag("block-content-type", rootCmd.Flags().Lookup("block-content-type"))
+	viper.BindPFlag("block-reason-header", rootCmd.Flags().Lookup("block-reason-header"))
+	viper.BindPFlag("access-log", rootCmd.Flags().Lookup("access-log"))
+	viper.BindPFlag("access-log-max-size", rootCmd.Flags().Lookup("access-log-max-size"))
+	viper.BindPFlag("access-log-rotate", rootCmd.Flags().Lookup("access-log-rotate"))
+	viper.BindPFlag("access-log-max-backups", rootCmd.Flags().Lookup("access-log-max-backups"))
+	viper.BindPFlag("webhook-url", rootCmd.Flags().Lookup("webhook-url"))
+	viper.BindPFlag("webhook-severity", rootCmd.Flags().Lookup("webhook-severity"))
+	viper.BindPFlag("webhook-queue", rootCmd.Flags().Lookup("webhook-queue"))
+	viper.BindPFlag("webhook-timeout", rootCmd.Flags().Lookup("webhook-timeout"))
+	viper.BindPFlag("pprof", rootCmd.Flags().Lookup("pprof"))
+	viper.BindPFlag("tls-cert", rootCmd.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("tls-key", rootCmd.Flags().Lookup("tls-key"))
+	viper.BindPFlag("shutdown-timeout", rootCmd.Flags().Lookup("shutdown-timeout"))
+	viper.BindPFlag("read-timeout", rootCmd.Flags().Lookup("read-timeout"))
+	viper.BindPFlag("write-timeout", rootCmd.Flags().Lookup("write-timeout"))
+	viper.BindPFlag("idle-timeout", rootCmd.Flags().Lookup("idle-timeout"))
+	viper.BindPFlag("max-conns-per-ip", rootCmd.Flags().Lookup("max-conns-per-ip"))
+	viper.BindPFlag("max-scan-bytes", rootCmd.Flags().Lookup("max-scan-bytes"))
+	viper.BindPFlag("invalid-utf8", rootCmd.Flags().Lookup("invalid-utf8"))
+	viper.BindPFlag("oversize", rootCmd.Flags().Lookup("oversize"))
+	viper.BindPFlag("rate-limit", rootCmd.Flags().Lookup("rate-limit"))
+	viper.BindPFlag("rate-burst", rootCmd.Flags().Lookup("rate-burst"))
+	viper.BindPFlag("max-concurrency", rootCmd.Flags().Lookup("max-concurrency"))
+	viper.BindPFlag("queue-timeout", rootCmd.Flags().Lookup("queue-timeout"))
+	viper.BindPFlag("ruleset", rootCmd.Flags().Lookup("ruleset"))
+	viper.BindPFlag("route", rootCmd.Flags().Lookup("route"))
+	viper.BindPFlag("cache-size", rootCmd.Flags().Lookup("cache-size"))
+	viper.BindPFlag("disabled-rules-file", rootCmd.Flags().Lookup("disabled-rules-file"))
+	viper.BindPFlag("context-window", rootCmd.PersistentFlags().Lookup("context-window"))
+	viper.BindPFlag("scratch-pool-size", rootCmd.PersistentFlags().Lookup("scratch-pool-size"))
 
-	rootCmd.Execute()
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(exitCode(err))
+	}
 }
 
 func run(cmd *cobra.Command, args []string) {
-	addr := fmt.Sprintf("0.0.0.0:%d", Port)
+	addr := net.JoinHostPort(Host, strconv.Itoa(Port))
 
 	Uptime = time.Now()
 	fmt.Printf("[%s] hwaf %s Running on %s\n", Uptime.Format(time.RFC3339), Version, addr)
 
-	h := requestHandler
-	if err := fasthttp.ListenAndServe(addr, h); err != nil {
+	go watchReload()
+	if PprofAddr != "" {
+		go servePprof(PprofAddr)
+	}
+
+	server := newServer(trackActive(rateLimit(router)))
+	done := make(chan struct{})
+	go watchShutdown(server, done)
+
+	var err error
+	if TLSCert != "" {
+		err = serveTLS(server, addr)
+	} else {
+		err = serve(server, addr)
+	}
+	if err != nil {
 		log.Fatalf("Error in ListenAndServe: %s", err)
 	}
+	<-done
 }
 
 func preRunE(cmd *cobra.Command, args []string) error {
-	Debug = viper.GetBool("debug")
+	if err := initRules(cmd, args); err != nil {
+		return err
+	}
+	Host = viper.GetString("host")
 	Port = viper.GetInt("port")
-	FilePath = viper.GetString("filepath")
-	Flag = viper.GetString("flag")
+	MaxBodyBytes = viper.GetInt("max-body-bytes")
+	DecodeBody = viper.GetBool("decode-body")
+	MaxDecodedBytes = viper.GetInt("max-decoded-bytes")
+	MaxScanBytes = viper.GetInt("max-scan-bytes")
+	Oversize = viper.GetString("oversize")
+	InvalidUTF8 = viper.GetString("invalid-utf8")
+	RateLimit = viper.GetFloat64("rate-limit")
+	RateBurst = viper.GetInt("rate-burst")
+	MaxConcurrency = viper.GetInt("max-concurrency")
+	QueueTimeout = viper.GetDuration("queue-timeout")
+	if MaxConcurrency <= 0 {
+		MaxConcurrency = runtime.GOMAXPROCS(0)
+	}
+	scanSlots = make(chan struct{}, MaxConcurrency)
+	DisabledRulesFile = viper.GetString("disabled-rules-file")
+	CacheSize = viper.GetInt("cache-size")
+	if CacheSize < 0 {
+		return fmt.Errorf("--cache-size must not be negative")
+	}
+	if DisabledRulesFile != "" {
+		if err := disabledRules.Load(DisabledRulesFile); err != nil {
+			return err
+		}
+	}
+	if path := viper.GetString("access-log"); path != "" {
+		maxSize := int64(viper.GetInt("access-log-max-size")) << 20
+		if err := openAccessLog(path, maxSize, viper.GetDuration("access-log-rotate"), viper.GetInt("access-log-max-backups")); err != nil {
+			return err
+		}
+	} else if QuietLog {
+		accessLog = stderrAccessLog()
+	}
+	WebhookSeverity = viper.GetString("webhook-severity")
+	if WebhookSeverity != "" && severityRank(WebhookSeverity) == 0 {
+		return fmt.Errorf("unknown webhook-severity: %s, expect one of %s", WebhookSeverity, strings.Join(severities, ", "))
+	}
+	if url := viper.GetString("webhook-url"); url != "" {
+		if viper.GetInt("webhook-queue") <= 0 {
+			return fmt.Errorf("--webhook-queue must be positive")
+		}
+		startWebhook(url, viper.GetInt("webhook-queue"), viper.GetDuration("webhook-timeout"))
+	}
+	Block = viper.GetBool("block")
+	ResponseMode = viper.GetString("response")
+	if ResponseMode != ResponseFull && ResponseMode != ResponseMinimal {
+		return fmt.Errorf("unknown response: %s, expect %s or %s", ResponseMode, ResponseFull, ResponseMinimal)
+	}
+	OnError = viper.GetString("on-error")
+	if OnError != OnErrorOpen && OnError != OnErrorClosed {
+		return fmt.Errorf("unknown on-error: %s, expect %s or %s", OnError, OnErrorOpen, OnErrorClosed)
+	}
+	scanBreaker = &breaker{threshold: viper.GetInt("breaker-threshold"), cooldown: viper.GetDuration("breaker-cooldown")}
+	if scanBreaker.threshold < 0 {
+		return fmt.Errorf("--breaker-threshold must not be negative")
+	}
+	blockTemplate = nil
+	if path := viper.GetString("block-template"); path != "" {
+		t, err := loadBlockTemplate(path)
+		if err != nil {
+			return err
+		}
+		blockTemplate = t
+	}
+	BlockContentType = viper.GetString("block-content-type")
+	BlockReasonHeader = viper.GetBool("block-reason-header")
+	Dedup = viper.GetBool("dedup")
+	FirstMatch = viper.GetBool("first-match")
+	SkipEmptyMatches = viper.GetBool("skip-empty-matches")
+	OncePerID = viper.GetBool("once-per-id")
+	ScanTimeout = viper.GetDuration("scan-timeout")
+	MaxMatches = viper.GetInt("max-matches")
+	if MaxMatches < 0 {
+		return fmt.Errorf("--max-matches must not be negative")
+	}
+	AdminToken = viper.GetString("admin-token")
+	ContentType = strings.TrimSpace(viper.GetString("content-type"))
+	if ContentType == "" {
+		return fmt.Errorf("--content-type must not be empty")
+	}
+	ShutdownTimeout = viper.GetDuration("shutdown-timeout")
+	PprofAddr = viper.GetString("pprof")
+	if PprofAddr != "" && PprofAddr == net.JoinHostPort(Host, strconv.Itoa(Port)) {
+		return fmt.Errorf("--pprof must not be the waf address %s", PprofAddr)
+	}
+	ReadTimeout = viper.GetDuration("read-timeout")
+	WriteTimeout = viper.GetDuration("write-timeout")
+	IdleTimeout = viper.GetDuration("idle-timeout")
+	MaxConnsPerIP = viper.GetInt("max-conns-per-ip")
+	if ReadTimeout < 0 || WriteTimeout < 0 || IdleTimeout < 0 || MaxConnsPerIP < 0 {
+		return fmt.Errorf("--read-timeout, --write-timeout, --idle-timeout and --max-conns-per-ip must not be negative")
+	}
+	TLSCert = viper.GetString("tls-cert")
+	TLSKey = viper.GetString("tls-key")
 
-	if FilePath == "" {
-		return fmt.Errorf("empty regex filepath")
+	if Oversize != OversizeTruncate && Oversize != OversizeReject {
+		return fmt.Errorf("unknown oversize: %s", Oversize)
+	}
+	if InvalidUTF8 != InvalidUTF8Reject && InvalidUTF8 != InvalidUTF8Sanitize {
+		return fmt.Errorf("unknown invalid-utf8: %s", InvalidUTF8)
+	}
+	if RateLimit < 0 || RateBurst < 0 {
+		return fmt.Errorf("--rate-limit and --rate-burst must not be negative")
+	}
+	if RateLimit > 0 && RateBurst == 0 {
+		RateBurst = int(math.Ceil(RateLimit))
+	}
+	if (TLSCert == "") != (TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if TLSCert != "" {
+		if err := loadCertificate(); err != nil {
+			return err
+		}
+	}
+	targets, err := parseScanTargets(viper.GetString("scan-targets"))
+	if err != nil {
+		return err
+	}
+	ScanTargets = targets
+	if viper.GetBool("scan-headers") {
+		ScanTargets[TargetHeaders] = true
+	}
+	if viper.GetBool("scan-cookies") {
+		ScanTargets[TargetCookies] = true
+	}
+	if viper.GetBool("scan-request-line") {
+		ScanTargets[TargetRequestLine] = true
+	}
+	ScanArgs = viper.GetBool("scan-args")
+	ScanMultipart = viper.GetBool("scan-multipart")
+	ScanJSON = viper.GetBool("scan-json")
+	MultipartFileBytes = viper.GetInt("multipart-file-bytes")
+	if MultipartFileBytes < 0 {
+		return fmt.Errorf("--multipart-file-bytes must not be negative")
+	}
+	HeaderInclude = headerSet(getStringSlice("header-include"))
+	HeaderExclude = headerSet(getStringSlice("header-exclude"))
+	normalize, err := parseNormalize(viper.GetString("normalize"))
+	if err != nil {
+		return err
+	}
+	Normalize = normalize
+	AllowNets, err = parseAllowIPs(getStringSlice("allow-ips"))
+	if err != nil {
+		return err
+	}
+	TrustedProxies, err = parseIPNets("trusted proxy", getStringSlice("trusted-proxies"))
+	if err != nil {
+		return err
+	}
+	CORSOrigins = make(map[string]bool)
+	for _, origin := range getStringSlice("cors-origin") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			CORSOrigins[origin] = true
+		}
+	}
+	AllowPaths = nil
+	for _, prefix := range getStringSlice("allow-paths") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			AllowPaths = append(AllowPaths, []byte(prefix))
+		}
+	}
+	DecodeBase64 = viper.GetBool("decode-base64")
+	Base64MinLen = viper.GetInt("base64-min-len")
+	if Base64MinLen < 4 {
+		return fmt.Errorf("--base64-min-len must be at least 4")
+	}
+	Rulesets, err = parseRulesets(getStringSlice("ruleset"))
+	if err != nil {
+		return err
+	}
+	Routes, err = parseRoutes(getStringSlice("route"), Rulesets)
+	if err != nil {
+		return err
+	}
+	log.Debug("Prerun", args)
+
+	if err := buildScratch(FilePaths...); err != nil {
+		return err
+	}
+	return buildRulesets()
+}
+
+// initRules reads the config and the flags shared by every command that loads rules
+func initRules(cmd *cobra.Command, args []string) error {
+	if config := viper.GetString("config"); config != "" {
+		if err := readConfig(cmd, config); err != nil {
+			return fmt.Errorf("read config %s: %s", config, err)
+		}
+	}
+	Debug = viper.GetBool("debug")
+	QuietLog = viper.GetBool("quiet")
+	FilePaths = getStringSlice("filepath")
+	RulesTimeout = viper.GetDuration("rules-timeout")
+	RulesHeaders = getStringSlice("rules-header")
+	Flag = viper.GetString("flag")
+	if err := validateFlag(Flag); err != nil {
+		return err
+	}
+	Mode = viper.GetString("mode")
+	SkipInvalid = viper.GetBool("skip-invalid")
+	Anchor = viper.GetBool("anchor")
+	MaxExprLen = viper.GetInt("max-expr-len")
+	if MaxExprLen < 0 {
+		return fmt.Errorf("--max-expr-len must not be negative")
+	}
+	PoolSize = viper.GetInt("scratch-pool-size")
+	ContextWindow = viper.GetInt("context-window")
+	if ContextWindow < 0 {
+		return fmt.Errorf("--context-window must not be negative")
+	}
+	if PoolSize <= 0 {
+		PoolSize = runtime.GOMAXPROCS(0)
 	}
 	if Debug {
 		log.SetLevel(log.DebugLevel)
+	} else if QuietLog {
+		/* per match details are debug, quiet also drops rule loading chatter */
+		log.SetLevel(log.WarnLevel)
 	} else {
 		log.SetLevel(log.InfoLevel)
 	}
-	log.Debug("Prerun", args)
+	switch format := viper.GetString("log-format"); format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log-format: %s, expect text or json", format)
+	}
 
-	/* used for store rules */
-	RegexMap = make(map[int]RegexLine)
+	if len(FilePaths) <= 0 {
+		return fmt.Errorf("empty regex filepath")
+	}
+	if Mode != ModeBlock && Mode != ModeStream && Mode != ModeVectored {
+		return fmt.Errorf("unknown mode: %s", Mode)
+	}
+	DbCache = viper.GetString("db-cache")
+	if DbCache != "" && Mode != ModeBlock {
+		log.Warn(fmt.Sprintf("--db-cache only caches block mode databases, %s mode rules are compiled on every load", Mode))
+	}
+	return nil
+}
 
-	/* TODO: 需要编译多个包含scratch的处理对象 */
-	err := buildScratch(FilePath)
+/* every flag can be set from the env as HWAF_ plus its upper cased name, - as _ */
+const EnvPrefix = "HWAF"
 
-	return err
+// read flags missing on the command line from the env, e.g. HWAF_PORT or HWAF_MAX_BODY_BYTES
+func initEnv() {
+	viper.SetEnvPrefix(EnvPrefix)
+	/* subcommand flags are bound as bench.input, read from HWAF_BENCH_INPUT */
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	viper.AutomaticEnv()
 }
 
-// build scratch for regex file.
-func buildScratch(filepath string) (err error) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return err
+// viper.GetStringSlice, but a list from the env is comma separated like on the
+// command line instead of split on spaces
+func getStringSlice(key string) []string {
+	if s, ok := viper.Get(key).(string); ok {
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
 	}
-	defer file.Close()
+	return viper.GetStringSlice(key)
+}
 
-	patterns := []*hyperscan.Pattern{}
-	var expr hyperscan.Expression
-	var id int
-	//flags := Flag
-	//flags := hyperscan.Caseless | hyperscan.Utf8Mode
-	flags, err := hyperscan.ParseCompileFlag(Flag)
-	if err != nil {
+/* viper key => flag of the subcommand flags, their keys like bench.input are not the flag name */
+var subcommandFlags = make(map[string]*pflag.Flag)
+
+// bind flag f of a subcommand to key, readConfig then knows when it was given
+func bindSubcommandFlag(key string, f *pflag.Flag) {
+	subcommandFlags[key] = f
+	viper.BindPFlag(key, f)
+}
+
+// read config file, its values override env vars but not flags given on the command line
+func readConfig(cmd *cobra.Command, path string) error {
+	conf := viper.New()
+	conf.SetConfigFile(path)
+	if err := conf.ReadInConfig(); err != nil {
 		return err
 	}
+	for _, key := range conf.AllKeys() {
+		f := subcommandFlags[key]
+		if f == nil {
+			f = cmd.Flags().Lookup(key)
+		}
+		if f != nil && f.Changed {
+			continue
+		}
+		viper.Set(key, conf.Get(key))
+	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-
-		log.Debug(scanner.Text())
-		line := scanner.Text()
+// lower cased header names
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return set
+}
 
-		// line start with #, skip
-		if strings.HasPrefix(strings.TrimSpace(line), "#") {
-			log.Info(fmt.Sprintf("line start with #, skip line: %s", line))
+// parse --scan-targets, e.g. "uri,body,headers"
+func parseScanTargets(s string) (map[string]bool, error) {
+	targets := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch t {
+		case "":
 			continue
+		case TargetURI, TargetBody, TargetHeaders, TargetCookies, TargetRequestLine:
+			targets[t] = true
+		default:
+			return nil, fmt.Errorf("unknown scan target: %s", t)
 		}
-		s := strings.Split(line, "\t")
+	}
+	if len(targets) <= 0 {
+		return nil, fmt.Errorf("empty scan targets")
+	}
+	return targets, nil
+}
 
-		// length less than 3, skip
-		if len(s) < 3 {
-			log.Info(fmt.Sprintf("line length less than 3, skip line: [%s] len(s):[%d]", line, len(s)))
-			continue
+// dispatch service endpoints, everything else is scanned
+func router(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Path()) {
+	case "/metrics":
+		methods(metricsHandler, "GET", "HEAD")(ctx)
+	case "/scan":
+		cors(methods(limitConcurrency(scanHandler), "POST"))(ctx)
+	case "/scan/bulk":
+		cors(methods(bulkScanHandler, "POST"))(ctx)
+	case "/healthz":
+		methods(healthzHandler, "GET", "HEAD")(ctx)
+	case "/version":
+		cors(methods(versionHandler, "GET", "HEAD"))(ctx)
+	case "/stats":
+		cors(methods(statsHandler, "GET", "HEAD"))(ctx)
+	case "/stats/rules":
+		cors(methods(ruleStatsHandler, "GET", "HEAD"))(ctx)
+	case "/info":
+		cors(methods(adminOnly(infoHandler), "GET", "HEAD"))(ctx)
+	case "/rules":
+		cors(methods(adminOnly(rulesHandler), "GET", "HEAD"))(ctx)
+	case "/rules/warnings":
+		cors(methods(adminOnly(ruleWarningsHandler), "GET", "HEAD"))(ctx)
+	case "/test":
+		cors(methods(adminOnly(limitConcurrency(testPatternHandler)), "POST"))(ctx)
+	case "/reload":
+		cors(methods(adminOnly(reloadHandler), "POST"))(ctx)
+	default:
+		if bytes.HasPrefix(ctx.Path(), []byte("/rules/")) {
+			cors(adminOnly(ruleHandler))(ctx)
+			return
 		}
+		limitConcurrency(requestHandler)(ctx)
+	}
+}
 
-		/* id */
-		id, err = strconv.Atoi(s[0])
-		if err != nil {
-			return fmt.Errorf("Atoi error.")
+/* returned by the event handler to stop at the first match */
+var errFirstMatch = errors.New("first match")
+
+/* scan stopped at --scan-timeout, the matches found so far are still returned */
+var errScanTimeout = errors.New("scan timeout")
+
+/* scan stopped at --max-matches, the matches kept are still returned */
+var errMaxMatches = errors.New("too many matches")
+
+// the database or a scratch failed a scan, the only scan errors counted by scanBreaker
+type engineError struct {
+	err error
+}
+
+func (e *engineError) Error() string {
+	return e.err.Error()
+}
+
+// one part of the request fed to Db.Scan
+type scanPart struct {
+	target   string
+	data     []byte
+	label    string /* prefixed to the match context, e.g. the header name */
+	decoded  string /* encodings data was decoded from, comma separated */
+	form     bool   /* data holds a query or form value from offset query on, its '+' are spaces */
+	query    int    /* with form, where the value starts, after the ? of the uri */
+	location string /* MatchResp.Location, e.g. header:User-Agent, the target when empty */
+
+	categories map[string]bool /* only report rules of these categories, all when nil */
+}
+
+// collect the request parts selected by --scan-targets
+func requestParts(ctx *fasthttp.RequestCtx) []scanPart {
+	var parts []scanPart
+	if ScanTargets[TargetRequestLine] {
+		parts = append(parts, requestLineParts(ctx)...)
+	}
+	if ScanTargets[TargetURI] && ScanArgs {
+		parts = append(parts, argParts(ctx)...)
+	} else if ScanTargets[TargetURI] {
+		uri := scanPart{target: TargetURI, data: ctx.RequestURI()}
+		if q := bytes.IndexByte(uri.data, '?'); q >= 0 {
+			uri.form, uri.query = true, q+1
+		}
+		parts = append(parts, uri)
+	}
+	if ScanTargets[TargetHeaders] {
+		parts = append(parts, headerParts(&ctx.Request.Header)...)
+	}
+	if ScanTargets[TargetCookies] {
+		parts = append(parts, cookieParts(&ctx.Request.Header)...)
+	}
+	if ScanTargets[TargetBody] {
+		/* a parsed form or json document replaces the raw body, see --scan-multipart and --scan-json */
+		if fields, ok := multipartParts(ctx); ok {
+			return append(parts, fields...)
 		}
+		if values, ok := jsonParts(ctx); ok {
+			return append(parts, values...)
+		}
+		body := ctx.PostBody()
+		var encoding string
+		if DecodeBody && len(body) > 0 {
+			if ce := ctx.Request.Header.Peek("Content-Encoding"); len(ce) > 0 {
+				decoded, truncated, err := decodeBody(string(ce), body, MaxDecodedBytes)
+				if err != nil {
+					log.Debug(fmt.Sprintf("decode body %s: %s, scan raw body", ce, err))
+				} else {
+					if truncated {
+						log.Debug(fmt.Sprintf("decoded body exceeds max-decoded-bytes, scan first %d bytes", MaxDecodedBytes))
+					}
+					body = decoded
+					encoding = string(ce)
+				}
+			}
+		}
+		if MaxBodyBytes > 0 && len(body) > MaxBodyBytes {
+			log.Debug(fmt.Sprintf("body length %d exceeds max-body-bytes, scan first %d bytes", len(body), MaxBodyBytes))
+			body = body[:MaxBodyBytes]
+		}
+		if len(body) > 0 {
+			form := bytes.HasPrefix(bytes.ToLower(ctx.Request.Header.ContentType()), []byte("application/x-www-form-urlencoded"))
+			parts = append(parts, scanPart{target: TargetBody, data: body, decoded: encoding, form: form})
+		}
+	}
+	return parts
+}
+
+// categories selected by the ?categories= query arg, nil when absent
+func queryCategories(ctx *fasthttp.RequestCtx) map[string]bool {
+	arg := ctx.QueryArgs().Peek("categories")
+	if len(arg) == 0 {
+		return nil
+	}
+	categories := make(map[string]bool)
+	for _, c := range strings.Split(string(arg), ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			categories[c] = true
+		}
+	}
+	return categories
+}
+
+// cut parts so their total size is at most max bytes, 0 means no limit
+func limitParts(parts []scanPart, max int) ([]scanPart, bool) {
+	if max <= 0 {
+		return parts, false
+	}
+	left := max
+	for i, part := range parts {
+		if len(part.data) > left {
+			/* hyperscan refuses an empty part, one cut to nothing is dropped */
+			if left == 0 {
+				return parts[:i], true
+			}
+			part.data = part.data[:left]
+			parts[i] = part
+			return parts[:i+1], true
+		}
+		left -= len(part.data)
+	}
+	return parts, false
+}
+
+// every header value is its own part, filtered by --header-include/--header-exclude
+func headerParts(header *fasthttp.RequestHeader) []scanPart {
+	var parts []scanPart
+	header.VisitAll(func(key, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		name := strings.ToLower(string(key))
+		if len(HeaderInclude) > 0 && !HeaderInclude[name] || HeaderExclude[name] {
+			return
+		}
+		/* scanned cookie by cookie instead */
+		if name == "cookie" && ScanTargets[TargetCookies] {
+			return
+		}
+		parts = append(parts, scanPart{target: TargetHeaders, data: value, label: string(key) + ": ", location: "header:" + string(key)})
+	})
+	return parts
+}
+
+// the method and the protocol on their own, so odd values are reported by component,
+// and the whole request line for rules spanning them. They are scanned as the client
+// sent them when the connection kept the raw line, see requestLineListener.
+func requestLineParts(ctx *fasthttp.RequestCtx) []scanPart {
+	method := ctx.Method()
+	line := rawRequestLine(ctx)
+	var protocol []byte
+	if line != nil {
+		protocol = requestProtocol(line)
+	} else {
+		protocol = []byte("HTTP/1.0")
+		if ctx.Request.Header.IsHTTP11() {
+			protocol = []byte("HTTP/1.1")
+		}
+		line = make([]byte, 0, len(method)+len(ctx.RequestURI())+len(protocol)+2)
+		line = append(append(append(line, method...), ' '), ctx.RequestURI()...)
+		line = append(append(line, ' '), protocol...)
+	}
+	return []scanPart{
+		{target: TargetRequestLine, data: method, label: "method: ", location: "method"},
+		{target: TargetRequestLine, data: protocol, label: "protocol: ", location: "protocol"},
+		{target: TargetRequestLine, data: line, label: "line: "},
+	}
+}
+
+// protocol token of a raw request line split as fasthttp does: the method up to
+// the first space, the protocol after the last space of the rest, none without it
+func requestProtocol(line []byte) []byte {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil
+	}
+	rest := line[i+1:]
+	if j := bytes.LastIndexByte(rest, ' '); j >= 0 {
+		return rest[j+1:]
+	}
+	return nil
+}
+
+// every cookie value is its own part, labelled with the cookie name
+func cookieParts(header *fasthttp.RequestHeader) []scanPart {
+	var parts []scanPart
+	header.VisitAllCookie(func(key, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		parts = append(parts, scanPart{target: TargetCookies, data: value, label: string(key) + "=", location: "cookie:" + string(key)})
+	})
+	return parts
+}
 
-		/* regex */
-		expr = hyperscan.Expression(s[1])
+// the uri path and every query arg value as its own part, labelled with the arg name
+func argParts(ctx *fasthttp.RequestCtx) []scanPart {
+	parts := []scanPart{{target: TargetURI, data: ctx.Path(), location: "path"}}
+	ctx.QueryArgs().VisitAll(func(key, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		parts = append(parts, scanPart{target: TargetURI, data: value, label: string(key) + "=", location: "arg:" + string(key), form: true})
+	})
+	return parts
+}
 
-		/* data */
-		data := s[2]
-		pattern := &hyperscan.Pattern{Expression: expr, Flags: flags, Id: id}
-		patterns = append(patterns, pattern)
-		RegexMap[id] = RegexLine{string(expr), data}
+// the match with up to window bytes around it. Without the l flag From is always 0,
+// so the snippet is the window bytes before To instead of the whole input prefix.
+func snippet(input []byte, from, to uint64, som bool, window int) string {
+	if to > uint64(len(input)) {
+		to = uint64(len(input))
+	}
+	w := uint64(window)
+	start := uint64(0)
+	if !som {
+		from = to
+	}
+	if from > to {
+		from = to
+	}
+	if from > w {
+		start = from - w
 	}
+	end := to + w
+	if end > uint64(len(input)) {
+		end = uint64(len(input))
+	}
+	return string(input[start:end])
+}
 
-	if len(patterns) <= 0 {
-		return fmt.Errorf("Empty regex")
+// input[from:to], offsets out of range are clamped instead of panicking
+func matchedText(input []byte, from, to uint64) string {
+	if to > uint64(len(input)) {
+		to = uint64(len(input))
+	}
+	if from > to {
+		from = to
+	}
+	return string(input[from:to])
+}
+
+// scan one request part, results are tagged with the part target
+func scanRequestPart(part scanPart) ([]MatchResp, error) {
+	/* hyperscan refuses empty input, which can't match anyway */
+	if len(part.data) == 0 {
+		return nil, nil
+	}
+	return scanParts([]scanPart{part})
+}
+
+// scan parts with the --filepath rules
+func scanParts(parts []scanPart) ([]MatchResp, error) {
+	return scanPartsIn(&Engine, parts)
+}
+
+// scan parts of a request with one engine, a scan per part or a single scan over all
+// parts in vectored mode. With --first-match it stops at the first match.
+func scanPartsIn(rules *atomic.Value, parts []scanPart) ([]MatchResp, error) {
+	/* hyperscan refuses an empty input with HS_INVALID, so every error left is the engine's */
+	var nonEmpty []scanPart
+	for _, part := range parts {
+		if len(part.data) > 0 {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	parts = nonEmpty
+	if len(parts) <= 0 {
+		return nil, nil
+	}
+	if DecodeBase64 {
+		/* full slice expression, never append into the caller's array */
+		parts = append(parts[:len(parts):len(parts)], base64Parts(parts)...)
 	}
-	log.Info(fmt.Sprintf("regex file line number: %d", len(patterns)))
-	log.Info("Start Building, please wait...")
-	db, err := hyperscan.NewBlockDatabase(patterns...)
-	Db = db
+	/* one snapshot for the whole request, ids are only looked up in its own regexMap */
+	e := acquireFrom(rules)
+	defer e.done()
 
+	/* scan the normalized inputs while match contexts are snippets of the data sent,
+	   found through the offset maps; --normalize=lowercase keeps the length */
+	scanned := make([][]byte, len(parts))
+	offsets := make([][]int, len(parts))
+	normalized := make([]bool, len(parts))
+	for i, part := range parts {
+		input, inputOffsets := normalizeInput(part)
+		/* hyperscan behaviour is undefined for invalid UTF-8 in UTF-8 mode */
+		if e.utf8 && !utf8.Valid(input) {
+			if InvalidUTF8 != InvalidUTF8Sanitize {
+				return nil, &invalidUTF8Error{target: part.target}
+			}
+			sanitized, sanitizedOffsets := sanitizeUTF8(input)
+			input, inputOffsets = sanitized, composeOffsets(inputOffsets, sanitizedOffsets)
+		}
+		if !bytes.Equal(input, part.data) {
+			normalized[i] = true
+		}
+		scanned[i], offsets[i] = input, inputOffsets
+		if Normalize[NormalizeLowercase] {
+			scanned[i] = lowercase(input)
+		}
+	}
+
+	matches := make([][]MatchResp, len(parts)) /* per part, so --dedup never merges across parts */
+	reported := make(map[uint]bool)            /* rule ids seen, for --once-per-id */
+	total, tooMany := 0, false                 /* matches collected, beyond --max-matches */
+
+	/* hyperscan can only be stopped from the event handler, so the deadline is checked
+	   at every match and between parts, a part without matches always runs to its end */
+	var deadline time.Time
+	if ScanTimeout > 0 {
+		deadline = time.Now().Add(ScanTimeout)
+	}
+	timedOut := false
+	expired := func() bool {
+		timedOut = timedOut || !deadline.IsZero() && time.Now().After(deadline)
+		return timedOut
+	}
+
+	match := func(i int, id uint, from, to uint64, flags uint) error {
+		if expired() {
+			return errScanTimeout
+		}
+		part := parts[i]
+		log.Debug(fmt.Sprintf("target: %s, id: %d, from: %d, to: %d, flags: %v", part.target, id, from, to, flags))
+		regexLine, ok := e.regexMap[int(id)]
+		if !ok {
+			regexLine = RegexLine{}
+		}
+		if part.categories != nil && !part.categories[regexLine.Category] {
+			return nil
+		}
+		if disabledRules.Has(int(id)) {
+			return nil
+		}
+		/* without the l flag from is always 0, only an empty match at offset 0 is seen */
+		if SkipEmptyMatches && from == to {
+			return nil
+		}
+		/* an allow match reported later may still suppress this one, with allow
+		   rules the limits are applied once they are known, see limitMatches */
+		limited := !e.allows
+		/* filtered here rather than with hyperscan.SingleMatch, which is per
+		   input and not allowed together with the l (SOM) flag */
+		if limited && OncePerID && reported[id] {
+			return nil
+		}
+		/* one more match than kept tells the results are cut off */
+		if limited && MaxMatches > 0 && total >= MaxMatches {
+			tooMany = true
+			return errMaxMatches
+		}
+		if limited {
+			total++
+			if OncePerID {
+				reported[id] = true
+			}
+		}
+		countRuleMatch(int(id), time.Now())
+		/* From/To are offsets into the scanned input, Context and Matched are what was sent */
+		rawFrom, rawTo := rawOffset(offsets[i], from), rawOffset(offsets[i], to)
+		location := part.location
+		if location == "" {
+			location = part.target
+		}
+		matchResp := MatchResp{Id: int(id), From: int(from), To: int(to), Flags: int(flags), Context: part.label + snippet(part.data, rawFrom, rawTo, strings.Contains(regexLine.Flags, "l"), ContextWindow), RegexLinev: regexLine, Target: part.target, Location: location, Normalized: normalized[i], Matched: matchedText(part.data, rawFrom, rawTo), Decoded: part.decoded}
+		matches[i] = append(matches[i], matchResp)
+		if limited && FirstMatch {
+			/* non-nil error makes hyperscan stop scanning */
+			return errFirstMatch
+		}
+		return nil
+	}
+
+	// every concurrent scan needs its own scratch
+	scratch, err := e.scratches.Get()
 	if err != nil {
-		return err
+		return nil, &engineError{err}
+	}
+	if e.mode == ModeVectored {
+		err = e.scanVector(scanned, scratch, match)
+	} else {
+		for i := range scanned {
+			if expired() || tooMany {
+				break
+			}
+			err = e.scanCached(scanned[i], scratch, func(id uint, from, to uint64, flags uint, context interface{}) error {
+				return match(i, id, from, to, flags)
+			})
+			if err != nil {
+				break
+			}
+		}
+	}
+	e.scratches.Put(scratch)
+
+	if isScanTerminated(err) && (FirstMatch || timedOut || tooMany) {
+		err = nil
 	}
-	scratch, err := hyperscan.NewScratch(Db)
 	if err != nil {
-		return err
+		return nil, &engineError{err}
+	}
+	for i, m := range matches {
+		matches[i] = suppressAllowed(m)
+	}
+	if e.allows {
+		tooMany = limitMatches(matches)
+	}
+	var matchResps []MatchResp
+	for _, m := range matches {
+		if Dedup {
+			m = dedupMatches(m)
+		}
+		matchResps = append(matchResps, sortByOffset(m)...)
+	}
+	sortBySeverity(matchResps)
+	if timedOut {
+		return matchResps, errScanTimeout
 	}
-	Scratch.s = scratch
+	if tooMany {
+		return matchResps, errMaxMatches
+	}
+	return matchResps, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+// matches of one part in input order, hyperscan reports them by end offset and
+// in no fixed order at all with some flags
+func sortByOffset(matchResps []MatchResp) []MatchResp {
+	sort.SliceStable(matchResps, func(i, j int) bool {
+		a, b := matchResps[i], matchResps[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Id < b.Id
+	})
+	return matchResps
+}
+
+// most severe matches first when rules have severities, matches of the same
+// severity stay in part and offset order
+func sortBySeverity(matchResps []MatchResp) {
+	sort.SliceStable(matchResps, func(i, j int) bool {
+		return severityRank(matchResps[i].RegexLinev.Severity) > severityRank(matchResps[j].RegexLinev.Severity)
+	})
+}
+
+// status of a request whose scan failed, per --on-error
+func scanErrorStatus() int {
+	if OnError == OnErrorOpen {
+		return fasthttp.StatusOK
 	}
-	return nil
+	return fasthttp.StatusForbidden
+}
+
+// the block decision alone, for --response=minimal
+func minimalResp(matchResps []MatchResp) MinimalResp {
+	for _, m := range matchResps {
+		if Block && m.RegexLinev.Action == ActionBlock {
+			return MinimalResp{Block: true, Rule: m.Id}
+		}
+	}
+	return MinimalResp{}
+}
+
+// data of the first blocking match, the most severe one as matches are sorted by severity
+func blockReason(matchResps []MatchResp) string {
+	for _, m := range matchResps {
+		if m.RegexLinev.Action == ActionBlock {
+			return m.RegexLinev.Data
+		}
+	}
+	return ""
+}
+
+/* longest block reason sent in a header */
+const maxHeaderReason = 256
+
+// s made safe for a header value, control characters would end or split the header
+func headerValue(s string) string {
+	b := []byte(s)
+	if len(b) > maxHeaderReason {
+		n := maxHeaderReason
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+		b = b[:n]
+	}
+	for i, c := range b {
+		if c < ' ' || c == 0x7f {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// block when any matched rule asks for it, other actions are log only
+func shouldBlock(matchResps []MatchResp) bool {
+	for _, m := range matchResps {
+		if m.RegexLinev.Action == ActionBlock {
+			return true
+		}
+	}
+	return false
 }
 
 func requestHandler(ctx *fasthttp.RequestCtx) {
 	//func matchHandle(w http.ResponseWriter, r *http.Request) {
 	var resp Response = Response{Errno: 0}
-	ctx.Response.Header.Set("Content-Type", "application/json")
-
-	inputData := []byte(ctx.RequestURI())
-
-	log.Info(fmt.Sprintf("\ninputData %q", inputData))
-	log.Info(fmt.Sprintf("Request method is %q", ctx.Method()))
-	log.Info(fmt.Sprintf("RequestURI is %q", ctx.RequestURI()))
-	log.Info(fmt.Sprintf("Requested path is %q", ctx.Path()))
-	log.Info(fmt.Sprintf("Host is %q", ctx.Host()))
-	log.Info(fmt.Sprintf("Query string is %q", ctx.QueryArgs()))
-	log.Info(fmt.Sprintf("User-Agent is %q", ctx.UserAgent()))
-	log.Info(fmt.Sprintf("Connection has been established at %s", ctx.ConnTime()))
-	log.Info(fmt.Sprintf("Request has been started at %s", ctx.Time()))
-	log.Info(fmt.Sprintf("Serial request number for the current connection is %d", ctx.ConnRequestNum()))
-	log.Info(fmt.Sprintf("Clent ip is %q", ctx.RemoteIP()))
-	log.Info(fmt.Sprintf("Raw request is:\n---CUT---\n%s\n---CUT---\n", &ctx.Request))
+	status := fasthttp.StatusOK
+
+	log.Debug(fmt.Sprintf("Request method is %q", ctx.Method()))
+	log.Debug(fmt.Sprintf("RequestURI is %q", ctx.RequestURI()))
+	log.Debug(fmt.Sprintf("Requested path is %q", ctx.Path()))
+	log.Debug(fmt.Sprintf("Host is %q", ctx.Host()))
+	log.Debug(fmt.Sprintf("Query string is %q", ctx.QueryArgs()))
+	log.Debug(fmt.Sprintf("User-Agent is %q", ctx.UserAgent()))
+	log.Debug(fmt.Sprintf("Connection has been established at %s", ctx.ConnTime()))
+	log.Debug(fmt.Sprintf("Request has been started at %s", ctx.Time()))
+	log.Debug(fmt.Sprintf("Serial request number for the current connection is %d", ctx.ConnRequestNum()))
+	log.Debug(fmt.Sprintf("Clent ip is %q, peer %q", clientIP(ctx), ctx.RemoteIP()))
+	/* raw request may carry credentials, only dump it in debug mode */
+	if Debug {
+		log.Debug(fmt.Sprintf("Raw request is:\n---CUT---\n%s\n---CUT---\n", &ctx.Request))
+	}
+
+	/* trusted traffic, e.g. health checks, is answered without scanning */
+	if isAllowed(ctx) {
+		resp.Errno = 2
+		resp.Msg = "allowed, not scanned"
+		writeJSON(ctx, status, resp)
+		logRequest(ctx, status, 0, nil)
+		return
+	}
+
+	parts, truncated := limitParts(requestParts(ctx), MaxScanBytes)
+	if truncated {
+		if Oversize == OversizeReject {
+			status = fasthttp.StatusRequestEntityTooLarge
+			resp.Errno = -3
+			resp.Msg = fmt.Sprintf("scan input exceeds %d bytes", MaxScanBytes)
+			writeJSON(ctx, status, resp)
+			logRequest(ctx, status, 0, nil)
+			return
+		}
+		resp.Truncated = true
+	}
 
 	// results
 	var matchResps []MatchResp
-	eventHandler := func(id uint, from, to uint64, flags uint, context interface{}) error {
-		log.Info(fmt.Sprintf("id: %d, from: %d, to: %d, flags: %v, context: %s", id, from, to, flags, context))
-		regexLine, ok := RegexMap[int(id)]
-		if !ok {
-			regexLine = RegexLine{}
+	var scanErr error
+	categories := queryCategories(ctx)
+	for i := range parts {
+		parts[i].categories = categories
+	}
+	start := time.Now()
+	if ok, probe := scanBreaker.allow(start); ok {
+		matchResps, scanErr = scanPartsIn(routeEngine(ctx.Path()), parts)
+		if scanErr == errMaxMatches {
+			resp.MatchesTruncated, scanErr = true, nil
 		}
-		matchResp := MatchResp{Id: int(id), From: int(from), To: int(to), Flags: int(flags), Context: fmt.Sprintf("%s", context), RegexLinev: regexLine}
-		matchResps = append(matchResps, matchResp)
-		return nil
+		scanBreaker.record(scanErr, time.Now(), probe)
+	} else {
+		scanErr = errBreakerOpen
 	}
+	scanTime := time.Since(start)
+	observeScan(scanTime, matchResps, scanErr)
 
-	// lock scratch
-	Scratch.Lock()
-	if err := Db.Scan(inputData, Scratch.s, eventHandler, inputData); err != nil {
-		/* TODO  */
-		logFields := log.Fields{"RequestURI": ctx.RequestURI()}
+	if _, ok := scanErr.(*invalidUTF8Error); ok {
+		resp.Errno = -1
+		resp.Msg = scanErr.Error()
+		status = fasthttp.StatusBadRequest
+	} else if scanErr == errScanTimeout {
+		log.WithFields(log.Fields{"RequestURI": ctx.RequestURI()}).Warn(fmt.Sprintf("scan exceeded %s, %d matches so far", ScanTimeout, len(matchResps)))
+		resp.Errno = -6
+		resp.Msg = fmt.Sprintf("scan exceeded %s, partial results", ScanTimeout)
+		resp.Data = matchResps
+		status = fasthttp.StatusServiceUnavailable
+	} else if scanErr == errBreakerOpen {
+		/* logged when tripping, not for every request let through or blocked meanwhile */
+		resp.Errno = -2
+		resp.Msg = scanErr.Error()
+		status = scanErrorStatus()
+	} else if scanErr != nil {
+		logFields := log.Fields{"RequestURI": ctx.RequestURI(), "OnError": OnError}
 
-		log.WithFields(logFields).Error(err)
+		log.WithFields(logFields).Error(scanErr)
 		resp.Errno = -2
-		resp.Msg = fmt.Sprintf("Db.Scan error: %s", err)
+		resp.Msg = fmt.Sprintf("Db.Scan error: %s", scanErr)
+		status = scanErrorStatus()
 	} else {
 		if len(matchResps) <= 0 {
 			resp.Errno = 1
 			resp.Msg = "no match"
+		} else if Block && shouldBlock(matchResps) {
+			status = fasthttp.StatusForbidden
+			resp.Reason = blockReason(matchResps)
+			if BlockReasonHeader && resp.Reason != "" {
+				ctx.Response.Header.Set("X-WAF-Block-Reason", headerValue(resp.Reason))
+			}
 		}
 		resp.Data = matchResps
 	}
-	// unlock scratch
-	Scratch.Unlock()
-
-	json.NewEncoder(ctx.Response.BodyWriter()).Encode(resp)
-	ctx.Response.Header.SetStatusCode(fasthttp.StatusForbidden)
-}
-
-/*
-func requestHandler(ctx *fasthttp.RequestCtx) {
-	fmt.Fprintf(ctx, "Hello, world!\n\n")
-
-	fmt.Fprintf(ctx, "Request method is %q\n", ctx.Method())
-	fmt.Fprintf(ctx, "RequestURI is %q\n", ctx.RequestURI())
-	fmt.Fprintf(ctx, "Requested path is %q\n", ctx.Path())
-	fmt.Fprintf(ctx, "Host is %q\n", ctx.Host())
-	fmt.Fprintf(ctx, "Query string is %q\n", ctx.QueryArgs())
-	fmt.Fprintf(ctx, "User-Agent is %q\n", ctx.UserAgent())
-	fmt.Fprintf(ctx, "Connection has been established at %s\n", ctx.ConnTime())
-	fmt.Fprintf(ctx, "Request has been started at %s\n", ctx.Time())
-	fmt.Fprintf(ctx, "Serial request number for the current connection is %d\n", ctx.ConnRequestNum())
-	fmt.Fprintf(ctx, "Your ip is %q\n\n", ctx.RemoteIP())
-
-	fmt.Fprintf(ctx, "Raw request is:\n---CUT---\n%s\n---CUT---", &ctx.Request)
 
-	ctx.SetContentType("text/plain; charset=utf8")
-
-	// Set arbitrary headers
-	ctx.Response.Header.Set("X-My-Header", "my-header-value")
-
-	// Set cookies
-	var c fasthttp.Cookie
-	c.SetKey("cookie-name")
-	c.SetValue("cookie-value")
-	ctx.Response.Header.SetCookie(&c)
+	/* a scan error blocked by --on-error=closed is no rule block, it keeps the json error */
+	if status == fasthttp.StatusForbidden && scanErr == nil && writeBlockPage(ctx, status, matchResps) {
+		/* answered with --block-template */
+	} else if ResponseMode == ResponseMinimal && scanErr == nil {
+		writeEncoded(ctx, status, minimalResp(matchResps))
+	} else {
+		writeJSON(ctx, status, resp)
+	}
+	notifyWebhook(ctx, status, matchResps)
+	logRequest(ctx, status, scanTime, matchResps)
 }
-*/
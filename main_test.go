@@ -1,15 +1,629 @@
 package main
 
 import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 )
 
+// write rules into a temp file, the caller removes it
+func writeRules(t *testing.T, rules string) string {
+	file, err := ioutil.TempFile("", "hwaf-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(rules); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
 // test build scratch
 func TestBuildScratch(t *testing.T) {
-	RegexMap = make(map[int]RegexLine)
 	filepath := "patterns/pattern1.txt"
 	err := buildScratch(filepath)
 	if err != nil {
 		t.Error(err)
 	}
 }
+
+// benchmark concurrent scans sharing the scratch pool
+func BenchmarkScanParallel(b *testing.B) {
+	log.SetLevel(log.WarnLevel)
+	PoolSize = runtime.GOMAXPROCS(0)
+	if err := buildScratch("patterns/pattern1.txt"); err != nil {
+		b.Fatal(err)
+	}
+	part := scanPart{target: TargetURI, data: []byte("what is the weather today?")}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := scanRequestPart(part); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// test build scratch from several files
+func TestBuildScratchMultiFiles(t *testing.T) {
+	err := buildScratch("patterns/pattern1.txt", "patterns/xss.txt")
+	if err != nil {
+		t.Error(err)
+	}
+	if n := len(currentEngine().regexMap); n != 6 {
+		t.Errorf("expect 6 rules, got %d", n)
+	}
+
+	err = buildScratch("patterns/pattern1.txt", "patterns/pattern2.txt")
+	if err == nil {
+		t.Error("expect duplicate id error")
+	}
+
+	err = buildScratch("patterns/pattern2.txt", "patterns/uri")
+	if err == nil {
+		t.Error("expect duplicate id error")
+	}
+}
+
+// test per-line flags column
+func TestBuildScratchLineFlags(t *testing.T) {
+	Flag = "o"
+	defer func() { Flag = "" }()
+	err := buildScratch("patterns/sqli.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if f := regexMap[201].Flags; f != "i" {
+		t.Errorf("expect flags i for 201, got %q", f)
+	}
+	if f := regexMap[202].Flags; f != "o" {
+		t.Errorf("expect global flags o for 202, got %q", f)
+	}
+}
+
+// test severity and action columns
+func TestBuildScratchSeverityAction(t *testing.T) {
+	if err := buildScratch("patterns/sqli.txt"); err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if r := regexMap[201]; r.Severity != "high" || r.Action != ActionBlock {
+		t.Errorf("unexpected rule 201: %+v", r)
+	}
+	if r := regexMap[202]; r.Severity != "medium" || r.Action != ActionLog {
+		t.Errorf("unexpected rule 202: %+v", r)
+	}
+	if !shouldBlock([]MatchResp{{Id: 201, RegexLinev: regexMap[201]}}) {
+		t.Error("expect block for rule 201")
+	}
+	if shouldBlock([]MatchResp{{Id: 202, RegexLinev: regexMap[202]}}) {
+		t.Error("expect log only for rule 202")
+	}
+}
+
+// test invalid regex is reported with its line, or skipped
+// test blank lines are skipped and an empty expression is rejected
+func TestBuildScratchEmptyLines(t *testing.T) {
+	path := writeRules(t, "\n1\tok\tdata\n   \n\t\t\n \t \n2\tfine\tdata\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(currentEngine().regexMap); n != 2 {
+		t.Errorf("expect 2 rules, got %d", n)
+	}
+
+	path2 := writeRules(t, "1\tok\tdata\n2\t\tdata\n3\t \tdata\n")
+	defer os.Remove(path2)
+	err := buildScratch(path2)
+	if err == nil || !strings.Contains(err.Error(), ":2: empty regex") {
+		t.Errorf("expect empty regex error at line 2, got %v", err)
+	}
+
+	SkipInvalid = true
+	defer func() { SkipInvalid = false }()
+	if err := buildScratch(path2); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(currentEngine().regexMap); n != 1 {
+		t.Errorf("expect empty regexes skipped, got %d rules", n)
+	}
+}
+
+// test a duplicate id within a file fails the load, or is skipped keeping the first
+func TestBuildScratchDuplicateId(t *testing.T) {
+	path := writeRules(t, "1\tfirst\tdata\n2\tother\tdata\n1\tsecond\tdata\n")
+	defer os.Remove(path)
+	err := buildScratch(path)
+	if err == nil || !strings.Contains(err.Error(), ":3: regex id 1 is already defined at ") {
+		t.Errorf("expect duplicate id error at line 3, got %v", err)
+	}
+
+	SkipInvalid = true
+	defer func() { SkipInvalid = false }()
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if len(regexMap) != 2 || regexMap[1].Expr != "first" {
+		t.Errorf("expect the duplicate skipped, got %+v", regexMap)
+	}
+	if matchResps, _ := scanRequestPart(scanPart{target: TargetBody, data: []byte("second")}); len(matchResps) != 0 {
+		t.Errorf("expect the skipped duplicate not compiled, got %+v", matchResps)
+	}
+}
+
+// test rule files without an id column are numbered by line
+func TestBuildScratchAutoId(t *testing.T) {
+	path := writeRules(t, "# quick list\n<script\tdata\tiou\n\non(error|load)\tdata\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if len(regexMap) != 2 || regexMap[2].Expr != "<script" || regexMap[4].Expr != "on(error|load)" || regexMap[2].Flags != "iou" {
+		t.Errorf("expect rules numbered 2 and 4, got %+v", regexMap)
+	}
+
+	/* a second such file is numbered on after the lines of the first */
+	other := writeRules(t, "union select\tsqli\n")
+	defer os.Remove(other)
+	if err := buildScratch(path, other); err != nil {
+		t.Fatal(err)
+	}
+	regexMap = currentEngine().regexMap
+	if len(regexMap) != 3 || regexMap[2].Expr != "<script" || regexMap[5].Expr != "union select" {
+		t.Errorf("expect rules numbered 2, 4 and 5, got %+v", regexMap)
+	}
+}
+
+// test --max-expr-len rejects long expressions and risky ones are flagged
+func TestExprGuardrails(t *testing.T) {
+	path := writeRules(t, "1\tabc\tdata\n2\tabcdefghijk\tdata\n")
+	defer os.Remove(path)
+	MaxExprLen = 10
+	defer func() { MaxExprLen = 0 }()
+	err := buildScratch(path)
+	if err == nil || !strings.Contains(err.Error(), ":2: regex id 2 is 11 bytes, over --max-expr-len 10") {
+		t.Errorf("expect max-expr-len error at line 2, got %v", err)
+	}
+
+	for expr, expect := range map[string]int{"abc": 0, ".*abc": 1, "a.*b.+c": 1, ".*a.*b": 2, "a{2000}": 1, "a{1,5000}b": 1, "a{2,10}": 0} {
+		if w := exprWarnings(expr); len(w) != expect {
+			t.Errorf("%s: expect %d warnings, got %q", expr, expect, w)
+		}
+	}
+}
+
+func TestValidateFlag(t *testing.T) {
+	for _, flag := range []string{"", "iou", "lc"} {
+		if err := validateFlag(flag); err != nil {
+			t.Errorf("%q: unexpected error %s", flag, err)
+		}
+	}
+	if err := validateFlag("iX"); err == nil || !strings.Contains(err.Error(), "unknown flag `X`") || !strings.Contains(err.Error(), "u (utf-8)") {
+		t.Errorf("expect error listing valid flags, got %v", err)
+	}
+}
+
+// test --anchor anchors only the rules asking for it
+func TestBuildScratchAnchor(t *testing.T) {
+	path := writeRules(t, "1\tadmin\t{\"anchor\": true}\n2\tadmin\t{\"anchor\": false}\n3\t^root\t{\"anchor\": true}\n")
+	defer os.Remove(path)
+	Anchor = true
+	defer func() { Anchor = false }()
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if regexMap[1].Expr != "^(?:admin)" || regexMap[2].Expr != "admin" || regexMap[3].Expr != "^root" {
+		t.Errorf("unexpected anchoring: %+v", regexMap)
+	}
+	matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte("/x/admin")})
+	if err != nil || len(matchResps) != 1 || matchResps[0].Id != 2 {
+		t.Errorf("expect only the unanchored rule to match, got %+v, %v", matchResps, err)
+	}
+}
+
+// test rules fetched from an http url with the auth header
+func TestBuildScratchURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("1\tabc\tdata\n2\tdef\tdata\n"))
+	}))
+	defer server.Close()
+
+	if err := buildScratch(server.URL); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expect 403 without header, got %v", err)
+	}
+	RulesHeaders = []string{"Authorization: Bearer secret"}
+	defer func() { RulesHeaders = nil }()
+	if err := buildScratch(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(currentEngine().regexMap); n != 2 {
+		t.Errorf("expect 2 rules, got %d", n)
+	}
+}
+
+// test the extended parameter column is parsed and applied
+func TestBuildScratchExt(t *testing.T) {
+	path := writeRules(t, "1\tabc\tdata\t\t\t\t\tmin_offset=5, max_offset=20\n2\tdef\tdata\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if ext := currentEngine().regexMap[1].Ext; ext != "min_offset=5,max_offset=20" {
+		t.Errorf("unexpected ext %q", ext)
+	}
+	for data, n := range map[string]int{"abc": 0, "12abc": 1, "12345678901234567890abc": 0} {
+		matchResps, err := scanRequestPart(scanPart{target: TargetBody, data: []byte(data)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matchResps) != n {
+			t.Errorf("%s: expect %d matches, got %+v", data, n, matchResps)
+		}
+	}
+
+	for _, ext := range []string{"min_offset", "foo=1", "min_offset=9,max_offset=3", "edit_distance=-1"} {
+		path := writeRules(t, "1\tabc\tdata\t\t\t\t\t"+ext+"\n")
+		defer os.Remove(path)
+		if err := buildScratch(path); err == nil {
+			t.Errorf("expect error for %q", ext)
+		}
+	}
+}
+
+// test yaml and json rule files are dispatched by extension
+func TestBuildScratchStructured(t *testing.T) {
+	if err := buildScratch("patterns/rules.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if r := currentEngine().regexMap[402]; r.Flags != "iu" || r.Action != ActionLog || r.Category != "lfi" {
+		t.Errorf("unexpected rule 402: %+v", r)
+	}
+
+	f, err := ioutil.TempFile("", "hwaf-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("[\n\t{\"id\": 1, \"expr\": \"abc\\\\d\", \"severity\": \"low\"},\n\t{\"id\": 2, \"expr\": \"\"}\n]\n")
+	f.Close()
+	path := f.Name() + ".json"
+	os.Rename(f.Name(), path)
+	defer os.Remove(path)
+	if err := buildScratch(path); err == nil || !strings.Contains(err.Error(), "rule 2: empty regex") {
+		t.Errorf("expect empty regex error of rule 2, got %v", err)
+	}
+	SkipInvalid = true
+	defer func() { SkipInvalid = false }()
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if r := currentEngine().regexMap[1]; r.Expr != `abc\d` || r.Severity != "low" {
+		t.Errorf("unexpected rule 1: %+v", r)
+	}
+
+	/* a rule without id is not skipped, it can't be reported */
+	noId := f.Name() + ".yaml"
+	if err := ioutil.WriteFile(noId, []byte("- id: 1\n  expr: abc\n- expr: def\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(noId)
+	if err := buildScratch(noId); err == nil || !strings.Contains(err.Error(), "rule 2: rule without id") {
+		t.Errorf("expect rule without id error with --skip-invalid, got %v", err)
+	}
+}
+
+func TestBuildScratchInvalid(t *testing.T) {
+	path := writeRules(t, "1\tok\tdata\n2\t(unclosed\tdata\n")
+	defer os.Remove(path)
+
+	err := buildScratch(path)
+	if err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("expect error at line 2, got %v", err)
+	}
+
+	SkipInvalid = true
+	defer func() { SkipInvalid = false }()
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := currentEngine().regexMap[2]; ok {
+		t.Error("invalid rule 2 should be skipped")
+	}
+}
+
+func TestLimitParts(t *testing.T) {
+	parts := []scanPart{{data: []byte("12345")}, {data: []byte("67890")}, {data: []byte("abc")}}
+	limited, truncated := limitParts(parts, 7)
+	if !truncated || len(limited) != 2 || string(limited[1].data) != "67" {
+		t.Errorf("unexpected limit result: %v %v", limited, truncated)
+	}
+	if _, truncated := limitParts(parts[:1], 5); truncated {
+		t.Error("expect no truncation at exact limit")
+	}
+	parts = []scanPart{{data: []byte("12345")}, {data: []byte("67890")}, {data: []byte("abc")}}
+	limited, truncated = limitParts(parts, 10)
+	if !truncated || len(limited) != 2 || string(limited[1].data) != "67890" {
+		t.Errorf("expect the part after the limit dropped, not cut to nothing: %v %v", limited, truncated)
+	}
+}
+
+func TestMatchedText(t *testing.T) {
+	input := []byte("select * from t")
+	if s := matchedText(input, 9, 13); s != "from" {
+		t.Errorf("got %q", s)
+	}
+	if s := matchedText(input, 0, 100); s != string(input) {
+		t.Errorf("got %q", s)
+	}
+	if s := matchedText(input, 20, 10); s != "" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	input := []byte("0123456789<script>0123456789")
+	if s := snippet(input, 10, 18, true, 3); s != "789<script>012" {
+		t.Errorf("snippet with start of match got %q", s)
+	}
+	if s := snippet(input, 0, 18, false, 3); s != "pt>012" {
+		t.Errorf("snippet without start of match got %q", s)
+	}
+	if s := snippet(input, 0, 3, true, 100); s != string(input) {
+		t.Errorf("snippet clamped to input got %q", s)
+	}
+}
+
+// test logical combination rules are reported by the combination id only
+func TestBuildScratchCombination(t *testing.T) {
+	if err := buildScratch("patterns/combination.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if f := currentEngine().regexMap[300].Flags; f != "c" {
+		t.Errorf("expect flags c, got %q", f)
+	}
+
+	matchResps, err := scanRequestPart(scanPart{target: TargetURI, data: []byte("/?id=1 UNION SELECT 1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].Id != 300 {
+		t.Errorf("expect combination 300 only, got %+v", matchResps)
+	}
+
+	matchResps, err = scanRequestPart(scanPart{target: TargetURI, data: []byte("/?q=union")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 0 {
+		t.Errorf("expect no match, got %+v", matchResps)
+	}
+}
+
+// test --on-error picks the status of failed scans
+func TestScanErrorStatus(t *testing.T) {
+	defer func() { OnError = "" }()
+	for policy, expect := range map[string]int{OnErrorOpen: fasthttp.StatusOK, OnErrorClosed: fasthttp.StatusForbidden, "": fasthttp.StatusForbidden} {
+		OnError = policy
+		if status := scanErrorStatus(); status != expect {
+			t.Errorf("on-error %q: expect %d, got %d", policy, expect, status)
+		}
+	}
+}
+
+// test flags are read from HWAF_ env vars, lists comma separated
+func TestEnv(t *testing.T) {
+	initEnv()
+	os.Setenv("HWAF_MAX_BODY_BYTES", "123")
+	os.Setenv("HWAF_FILEPATH", "a.txt, b.txt")
+	defer os.Unsetenv("HWAF_MAX_BODY_BYTES")
+	defer os.Unsetenv("HWAF_FILEPATH")
+	if n := viper.GetInt("max-body-bytes"); n != 123 {
+		t.Errorf("expect max-body-bytes from HWAF_MAX_BODY_BYTES, got %d", n)
+	}
+	if list := getStringSlice("filepath"); len(list) != 2 || list[1] != "b.txt" {
+		t.Errorf("expect comma separated filepath, got %q", list)
+	}
+}
+
+// test --filepath - reads the rules from stdin once, reloads reuse them
+func TestBuildScratchStdin(t *testing.T) {
+	stdinOnce = sync.Once{}
+	rulesStdin = strings.NewReader("# piped\n1\t<script\tdata\nshort line\n")
+	defer func() { stdinOnce, rulesStdin = sync.Once{}, os.Stdin }()
+	for i := 0; i < 2; i++ {
+		if err := buildScratch(StdinPath); err != nil {
+			t.Fatal(err)
+		}
+		if regexMap := currentEngine().regexMap; len(regexMap) != 1 || regexMap[1].Expr != "<script" {
+			t.Errorf("load %d: unexpected rules %+v", i, regexMap)
+		}
+	}
+}
+
+// test every way of loading no rules exits with its own code
+func TestRulesExitCodes(t *testing.T) {
+	empty := writeRules(t, " \n\n")
+	defer os.Remove(empty)
+	skipped := writeRules(t, "# comment\nshort\n")
+	defer os.Remove(skipped)
+	invalid := writeRules(t, "1\t(unclosed\tdata\n")
+	defer os.Remove(invalid)
+	first := writeRules(t, "1\t<script\tdata\n")
+	defer os.Remove(first)
+	duplicate := writeRules(t, "1\tonload\tdata\n")
+	defer os.Remove(duplicate)
+
+	for path, want := range map[string]int{
+		"patterns/missing.txt": ExitRulesNotFound,
+		empty:                  ExitRulesEmpty,
+		skipped:                ExitRulesSkipped,
+		invalid:                ExitRulesInvalid,
+	} {
+		err := buildScratch(path)
+		if err == nil {
+			t.Errorf("%s: want error", path)
+			continue
+		}
+		if code := exitCode(err); code != want {
+			t.Errorf("%s: exit code %d, want %d (%s)", path, code, want, err)
+		}
+	}
+	if code := exitCode(buildScratch(first, duplicate)); code != ExitRulesInvalid {
+		t.Errorf("id defined in two files: exit code %d, want %d", code, ExitRulesInvalid)
+	}
+	if code := exitCode(errors.New("other")); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+}
+
+// test a --filepath glob loads every matching file in sorted order
+func TestBuildScratchGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hwaf-glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/b.txt", []byte("2\tonload\tb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/a.txt", []byte("1\t<script\ta\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/c.md", []byte("3\tignored\tc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := buildScratch(dir + "/*.txt"); err != nil {
+		t.Fatal(err)
+	}
+	e := currentEngine()
+	if want := []string{dir + "/a.txt", dir + "/b.txt"}; strings.Join(e.filepaths, ",") != strings.Join(want, ",") {
+		t.Errorf("files %v, want %v", e.filepaths, want)
+	}
+	if len(e.regexMap) != 2 {
+		t.Errorf("%d rules, want 2", len(e.regexMap))
+	}
+
+	err = buildScratch(dir + "/*.yaml")
+	if err == nil || exitCode(err) != ExitRulesNotFound {
+		t.Errorf("glob matching nothing: %v", err)
+	}
+}
+
+// test pprof is served on its mux and not on the waf port
+func TestPprofMux(t *testing.T) {
+	w := httptest.NewRecorder()
+	pprofMux().ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("expect pprof index, got %d", w.Code)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/debug/pprof/")
+	router(ctx)
+	if strings.Contains(string(ctx.Response.Body()), "goroutine") {
+		t.Errorf("pprof served on the waf port: %s", ctx.Response.Body())
+	}
+}
+
+// test a subcommand flag given on the command line wins over the config file
+func TestReadConfigSubcommandFlag(t *testing.T) {
+	cmd := &cobra.Command{Use: "sub"}
+	cmd.Flags().String("input", "", "")
+	cmd.Flags().String("output", "", "")
+	bindSubcommandFlag("sub.input", cmd.Flags().Lookup("input"))
+	bindSubcommandFlag("sub.output", cmd.Flags().Lookup("output"))
+	defer func() {
+		delete(subcommandFlags, "sub.input")
+		delete(subcommandFlags, "sub.output")
+	}()
+	if err := cmd.Flags().Parse([]string{"--input=flag.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "hwaf-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("sub:\n  input: config.txt\n  output: config.out\n")
+	file.Close()
+	path := file.Name() + ".yaml"
+	if err := os.Rename(file.Name(), path); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	if err := readConfig(cmd, path); err != nil {
+		t.Fatal(err)
+	}
+	if input := viper.GetString("sub.input"); input != "flag.txt" {
+		t.Errorf("expect the flag to win, got %q", input)
+	}
+	if output := viper.GetString("sub.output"); output != "config.out" {
+		t.Errorf("expect the config value without the flag, got %q", output)
+	}
+}
+
+// test the config command hides secrets
+func TestRedactSettings(t *testing.T) {
+	settings := redactSettings(map[string]interface{}{
+		"port":         8080,
+		"admin-token":  "s3cret",
+		"rules-header": []string{"Authorization: Bearer x"},
+		"tls-key":      "",
+	})
+	if settings["admin-token"] != "***" || settings["rules-header"] != "***" {
+		t.Errorf("secrets printed: %v", settings)
+	}
+	if settings["port"] != 8080 || settings["tls-key"] != "" {
+		t.Errorf("unexpected settings %v", settings)
+	}
+}
+
+// test trailing comment columns are dropped while # in a regex is kept
+func TestBuildScratchComments(t *testing.T) {
+	path := writeRules(t, "1\ta#b\tfragment\t# # in the regex is not a comment\n"+
+		"2\t#x\t\\#tag\ti\t# data starts with an escaped #\n"+
+		"3\t<script\txss\til\thigh\t#no space needed\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	regexMap := currentEngine().regexMap
+	if l := regexMap[1]; l.Expr != "a#b" || l.Data != "fragment" {
+		t.Errorf("rule 1 mangled: %+v", l)
+	}
+	if l := regexMap[2]; l.Expr != "#x" || l.Data != "#tag" || !strings.Contains(l.Flags, "i") {
+		t.Errorf("rule 2 mangled: %+v", l)
+	}
+	if l := regexMap[3]; l.Severity != "high" || l.Category != "" {
+		t.Errorf("rule 3 mangled: %+v", l)
+	}
+
+	matchResps, err := scanRequestPart(scanPart{target: "body", data: []byte("a#b #X")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 2 {
+		t.Errorf("expect rules 1 and 2 to match, got %+v", matchResps)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp" /* http parse lib */
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* prometheus metrics, exposed in text format on /metrics */
+var (
+	requestsTotal   uint64
+	matchesTotal    uint64
+	scanErrorsTotal uint64
+	ruleMatches     sync.Map /* rule id => *ruleStat */
+	scanDuration    = newHistogram([]float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1})
+)
+
+// matches of one rule, updated atomically
+type ruleStat struct {
+	count uint64
+	last  int64 /* unix nano of the last match */
+}
+
+/* GET /stats/rules item */
+type RuleStatResp struct {
+	Id        int        `json:"id"`
+	Matches   uint64     `json:"matches"`
+	LastMatch *time.Time `json:"last_match,omitempty"` /* absent when the rule never fired */
+}
+
+// count a match of rule id, called from the scan event handler
+func countRuleMatch(id int, now time.Time) {
+	s, ok := ruleMatches.Load(id)
+	if !ok {
+		s, _ = ruleMatches.LoadOrStore(id, new(ruleStat))
+	}
+	atomic.AddUint64(&s.(*ruleStat).count, 1)
+	atomic.StoreInt64(&s.(*ruleStat).last, now.UnixNano())
+}
+
+// matches of rule id so far, zero when it never fired
+func loadRuleStat(id int) (count uint64, last time.Time) {
+	s, ok := ruleMatches.Load(id)
+	if !ok {
+		return 0, time.Time{}
+	}
+	count = atomic.LoadUint64(&s.(*ruleStat).count)
+	last = time.Unix(0, atomic.LoadInt64(&s.(*ruleStat).last))
+	return count, last
+}
+
+// sorted ids of the loaded rules
+func loadedRuleIds() []int {
+	var ids []int
+	for id := range currentEngine().regexMap {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// histogram with fixed upper bounds, in seconds
+type histogram struct {
+	bounds []float64
+	counts []uint64 /* observations per bucket, last one is +Inf */
+	count  uint64
+	sumNs  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNs, uint64(d.Nanoseconds()))
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadUint64(&h.count))
+	fmt.Fprintf(w, "%s_sum %g\n", name, float64(atomic.LoadUint64(&h.sumNs))/1e9)
+	fmt.Fprintf(w, "%s_count %d\n", name, atomic.LoadUint64(&h.count))
+}
+
+// record the outcome of scanning one request
+func observeScan(d time.Duration, matchResps []MatchResp, err error) {
+	atomic.AddUint64(&requestsTotal, 1)
+	scanDuration.Observe(d)
+	if err != nil {
+		atomic.AddUint64(&scanErrorsTotal, 1)
+		return
+	}
+	atomic.AddUint64(&matchesTotal, uint64(len(matchResps)))
+}
+
+// GET /metrics
+func metricsHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4")
+
+	fmt.Fprintf(ctx, "# HELP hwaf_requests_total Total number of scanned requests.\n# TYPE hwaf_requests_total counter\n")
+	fmt.Fprintf(ctx, "hwaf_requests_total %d\n", atomic.LoadUint64(&requestsTotal))
+	fmt.Fprintf(ctx, "# HELP hwaf_matches_total Total number of rule matches.\n# TYPE hwaf_matches_total counter\n")
+	fmt.Fprintf(ctx, "hwaf_matches_total %d\n", atomic.LoadUint64(&matchesTotal))
+	fmt.Fprintf(ctx, "# HELP hwaf_scan_errors_total Total number of failed scans.\n# TYPE hwaf_scan_errors_total counter\n")
+	fmt.Fprintf(ctx, "hwaf_scan_errors_total %d\n", atomic.LoadUint64(&scanErrorsTotal))
+	fmt.Fprintf(ctx, "# HELP hwaf_webhook_dropped_total Webhook events dropped on a full queue.\n# TYPE hwaf_webhook_dropped_total counter\n")
+	fmt.Fprintf(ctx, "hwaf_webhook_dropped_total %d\n", atomic.LoadUint64(&webhookDropped))
+
+	/* every loaded rule gets a series, so never firing rules show up as 0 */
+	ids := loadedRuleIds()
+	fmt.Fprintf(ctx, "# HELP hwaf_rule_matches_total Total number of matches per rule id.\n# TYPE hwaf_rule_matches_total counter\n")
+	for _, id := range ids {
+		n, _ := loadRuleStat(id)
+		fmt.Fprintf(ctx, "hwaf_rule_matches_total{id=\"%d\"} %d\n", id, n)
+	}
+
+	fmt.Fprintf(ctx, "# HELP hwaf_scan_duration_seconds Scan latency per request.\n# TYPE hwaf_scan_duration_seconds histogram\n")
+	scanDuration.write(ctx, "hwaf_scan_duration_seconds")
+}
+
+/* GET /stats */
+type StatsResp struct {
+	Requests     uint64  `json:"requests"`
+	Matches      uint64  `json:"matches"`
+	ScanErrors   uint64  `json:"scan_errors"`
+	CacheEntries int     `json:"cache_entries"`
+	CacheHits    uint64  `json:"cache_hits"`
+	CacheMisses  uint64  `json:"cache_misses"`
+	CacheHitRate float64 `json:"cache_hit_rate"` /* since start, 0 without lookups */
+}
+
+// GET /stats, request counters and the result cache hit rate
+func statsHandler(ctx *fasthttp.RequestCtx) {
+	stats := StatsResp{
+		Requests:    atomic.LoadUint64(&requestsTotal),
+		Matches:     atomic.LoadUint64(&matchesTotal),
+		ScanErrors:  atomic.LoadUint64(&scanErrorsTotal),
+		CacheHits:   atomic.LoadUint64(&cacheHits),
+		CacheMisses: atomic.LoadUint64(&cacheMisses),
+	}
+	if e := currentEngine(); e != nil && e.cache != nil {
+		stats.CacheEntries = e.cache.Len()
+	}
+	if lookups := stats.CacheHits + stats.CacheMisses; lookups > 0 {
+		stats.CacheHitRate = float64(stats.CacheHits) / float64(lookups)
+	}
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: stats})
+}
+
+// GET /stats/rules, match count and last match time of every loaded rule
+func ruleStatsHandler(ctx *fasthttp.RequestCtx) {
+	ids := loadedRuleIds()
+	stats := make([]RuleStatResp, 0, len(ids))
+	for _, id := range ids {
+		stat := RuleStatResp{Id: id}
+		if n, last := loadRuleStat(id); n > 0 {
+			stat.Matches = n
+			stat.LastMatch = &last
+		}
+		stats = append(stats, stat)
+	}
+	writeJSON(ctx, fasthttp.StatusOK, Response{Errno: 0, Data: stats})
+}
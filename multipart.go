@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"sort"
+)
+
+/* multipart parts are marked with this in MatchResp.Decoded */
+const EncodingMultipart = "multipart"
+
+// every field value of a multipart/form-data body, and the first --multipart-file-bytes
+// of every uploaded file, as its own part. false when not enabled or the body is not a
+// valid form, the raw body is scanned then.
+func multipartParts(ctx *fasthttp.RequestCtx) ([]scanPart, bool) {
+	if !ScanMultipart || !bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("multipart/form-data")) {
+		return nil, false
+	}
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		log.Debug(fmt.Sprintf("parse multipart form: %s, scan raw body", err))
+		return nil, false
+	}
+
+	var parts []scanPart
+	/* sorted so parts, and so matches, keep the same order between requests */
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range form.Value[name] {
+			if value != "" {
+				parts = append(parts, scanPart{target: TargetBody, data: []byte(value), label: name + "=", decoded: EncodingMultipart, location: "form:" + name})
+			}
+		}
+	}
+	if MultipartFileBytes <= 0 {
+		return parts, true
+	}
+
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, fh := range form.File[name] {
+			data, err := readUpload(fh, MultipartFileBytes)
+			if err != nil {
+				log.Debug(fmt.Sprintf("read upload %s: %s", fh.Filename, err))
+				continue
+			}
+			if len(data) > 0 {
+				parts = append(parts, scanPart{target: TargetBody, data: data, label: fmt.Sprintf("%s (%s): ", fh.Filename, name), decoded: EncodingMultipart, location: "file:" + name})
+			}
+		}
+	}
+	return parts, true
+}
+
+// first max bytes of an uploaded file, larger files are only scanned partially
+func readUpload(fh *multipart.FileHeader, max int) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.LimitReader(f, int64(max)))
+}
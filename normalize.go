@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/* input normalizations applied before scanning, see --normalize */
+const (
+	NormalizeURL       = "url"
+	NormalizeDoubleURL = "double-url"
+	NormalizeLowercase = "lowercase"
+)
+
+// parse --normalize, e.g. "url" or "double-url,lowercase"
+func parseNormalize(s string) (map[string]bool, error) {
+	normalize := make(map[string]bool)
+	for _, n := range strings.Split(s, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		switch n {
+		case "":
+			continue
+		case NormalizeURL, NormalizeDoubleURL, NormalizeLowercase:
+			normalize[n] = true
+		default:
+			return nil, fmt.Errorf("unknown normalize: %s", n)
+		}
+	}
+	return normalize, nil
+}
+
+// normalize the data of part for scanning, the original data is left untouched.
+// offsets maps each offset of the result to the offset in part.data it came from,
+// see rawOffset, and is nil when nothing was decoded.
+func normalizeInput(part scanPart) (data []byte, offsets []int) {
+	data = part.data
+	plus := -1 /* '+' is a literal outside query and form values, e.g. in the path */
+	if part.form {
+		plus = part.query
+	}
+	passes := 0
+	if Normalize[NormalizeURL] || Normalize[NormalizeDoubleURL] {
+		passes = 1
+	}
+	if Normalize[NormalizeDoubleURL] {
+		passes = 2
+	}
+	for ; passes > 0; passes-- {
+		decoded, decodedOffsets := urlDecode(data, plus)
+		if decodedOffsets == nil {
+			break
+		}
+		if plus >= 0 {
+			/* where the form value starts in the decoded data, for the next pass */
+			next := 0
+			for next < len(decoded) && decodedOffsets[next] < plus {
+				next++
+			}
+			plus = next
+		}
+		data, offsets = decoded, composeOffsets(offsets, decodedOffsets)
+	}
+	return data, offsets
+}
+
+// urlDecode decodes %XX escapes, and '+' from offset plus on as a space when plus
+// isn't negative. Invalid escapes are kept as is so a broken sequence can't hide
+// the rest of the payload. offsets maps each offset of decoded to the one in data,
+// see rawOffset, and is nil when nothing was decoded.
+func urlDecode(data []byte, plus int) (decoded []byte, offsets []int) {
+	if bytes.IndexByte(data, '%') < 0 && (plus < 0 || plus >= len(data) || bytes.IndexByte(data[plus:], '+') < 0) {
+		return data, nil
+	}
+	decoded = make([]byte, 0, len(data))
+	offsets = make([]int, 0, len(data)+1)
+	for i := 0; i < len(data); i++ {
+		offsets = append(offsets, i)
+		switch c := data[i]; {
+		case c == '+' && plus >= 0 && i >= plus:
+			decoded = append(decoded, ' ')
+		case c == '%' && i+2 < len(data) && isHex(data[i+1]) && isHex(data[i+2]):
+			decoded = append(decoded, unhex(data[i+1])<<4|unhex(data[i+2]))
+			i += 2
+		default:
+			decoded = append(decoded, c)
+		}
+	}
+	return decoded, append(offsets, len(data))
+}
+
+// offsets of the data an offset map was made from mapped on through outer, the
+// map of the data before; nil outer is no mapping before
+func composeOffsets(outer, inner []int) []int {
+	if outer == nil {
+		return inner
+	}
+	if inner == nil {
+		return outer
+	}
+	composed := make([]int, len(inner))
+	for i, o := range inner {
+		composed[i] = outer[o]
+	}
+	return composed
+}
+
+// the offset in the original data of offset o of a normalized copy, by its
+// offset map; out of range offsets are clamped to the end
+func rawOffset(offsets []int, o uint64) uint64 {
+	if offsets == nil {
+		return o
+	}
+	if o >= uint64(len(offsets)) {
+		return uint64(offsets[len(offsets)-1])
+	}
+	return uint64(offsets[o])
+}
+
+// lowercase a copy of data for scanning case sensitive rules. Only runes whose
+// lower case encodes to as many bytes are changed, so offsets into the copy are
+// offsets into data; invalid UTF-8 bytes are kept as they are.
+func lowercase(data []byte) []byte {
+	lower := make([]byte, len(data))
+	for i := 0; i < len(data); {
+		c := data[i]
+		if c < utf8.RuneSelf {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			lower[i] = c
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if l := unicode.ToLower(r); r != utf8.RuneError && l != r && utf8.RuneLen(l) == size {
+			utf8.EncodeRune(lower[i:], l)
+		} else {
+			copy(lower[i:i+size], data[i:i+size])
+		}
+		i += size
+	}
+	return lower
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+/* decoded base64 parts are marked with this in MatchResp.Decoded */
+const EncodingBase64 = "base64"
+
+// a base64 run of an input and what it decodes to
+type base64Segment struct {
+	offset  int
+	encoded []byte
+	decoded []byte
+}
+
+// extra parts to scan for the base64 runs of parts, see --decode-base64
+func base64Parts(parts []scanPart) []scanPart {
+	var extra []scanPart
+	for _, part := range parts {
+		data, offsets := normalizeInput(part)
+		for _, seg := range findBase64(data, Base64MinLen) {
+			decoded := EncodingBase64
+			if part.decoded != "" {
+				decoded = part.decoded + "," + EncodingBase64
+			}
+			extra = append(extra, scanPart{
+				target:     part.target,
+				data:       seg.decoded,
+				label:      fmt.Sprintf("base64 decoded from offset %d: ", rawOffset(offsets, uint64(seg.offset))),
+				decoded:    decoded,
+				location:   part.location,
+				categories: part.categories,
+			})
+		}
+	}
+	return extra
+}
+
+// find runs of at least minLen base64 characters which decode to plausible text,
+// so long words, paths and binary tokens are not scanned as decoded garbage.
+func findBase64(data []byte, minLen int) []base64Segment {
+	var segments []base64Segment
+	for i := 0; i < len(data); {
+		if !isBase64(data[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(data) && isBase64(data[j]) {
+			j++
+		}
+		end := j
+		for end < len(data) && end-j < 2 && data[end] == '=' {
+			end++
+		}
+		if j-i >= minLen {
+			if decoded, ok := decodeBase64(data[i:j]); ok {
+				segments = append(segments, base64Segment{offset: i, encoded: data[i:end], decoded: decoded})
+			}
+		}
+		i = end
+	}
+	return segments
+}
+
+// decode an unpadded run of the standard or url safe alphabet
+func decodeBase64(run []byte) ([]byte, bool) {
+	enc := base64.RawStdEncoding
+	if bytes.ContainsAny(run, "-_") {
+		if bytes.ContainsAny(run, "+/") {
+			return nil, false
+		}
+		enc = base64.RawURLEncoding
+	}
+	/* a single trailing character carries no whole byte */
+	if len(run)%4 == 1 {
+		run = run[:len(run)-1]
+	}
+	decoded := make([]byte, enc.DecodedLen(len(run)))
+	n, err := enc.Decode(decoded, run)
+	if err != nil {
+		return nil, false
+	}
+	decoded = decoded[:n]
+	return decoded, isPlausibleText(decoded)
+}
+
+// valid utf-8 with at least 90% printable runes
+func isPlausibleText(data []byte) bool {
+	if len(data) == 0 || !utf8.Valid(data) {
+		return false
+	}
+	var runes, printable int
+	for _, r := range string(data) {
+		runes++
+		if unicode.IsPrint(r) || r == '\t' || r == '\n' || r == '\r' {
+			printable++
+		}
+	}
+	return printable*10 >= runes*9
+}
+
+func isBase64(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '+' || c == '/' || c == '-' || c == '_'
+}
+
+// input of target is not UTF-8 while the rules are compiled with the u flag
+type invalidUTF8Error struct {
+	target string
+}
+
+func (e *invalidUTF8Error) Error() string {
+	return fmt.Sprintf("%s is not valid UTF-8, the rules are compiled in UTF-8 mode (u flag), see --invalid-utf8", e.target)
+}
+
+// replace each invalid UTF-8 byte with U+FFFD, offsets maps the offsets of
+// sanitized back to data like the ones of urlDecode
+func sanitizeUTF8(data []byte) (sanitized []byte, offsets []int) {
+	sanitized = make([]byte, 0, len(data))
+	offsets = make([]int, 0, len(data)+1)
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			sanitized = append(sanitized, "\uFFFD"...)
+			for len(offsets) < len(sanitized) {
+				offsets = append(offsets, i)
+			}
+		} else {
+			sanitized = append(sanitized, data[i:i+size]...)
+			for k := 0; k < size; k++ {
+				offsets = append(offsets, i+k)
+			}
+		}
+		i += size
+	}
+	return sanitized, append(offsets, len(data))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/valyala/fasthttp"
+	"os"
+	"testing"
+)
+
+func TestUrlDecode(t *testing.T) {
+	cases := map[string]string{
+		"/index":           "/index",
+		"%3Cscript%3E":     "<script>",
+		"a+b%20c":          "a b c",
+		"%3":               "%3",
+		"%zz%3c":           "%zz<",
+		"%253Cscript%253E": "%3Cscript%3E",
+		"100%25%20sure%2":  "100% sure%2",
+	}
+	for in, expect := range cases {
+		if out, _ := urlDecode([]byte(in), 0); string(out) != expect {
+			t.Errorf("urlDecode(%q) = %q, expect %q", in, out, expect)
+		}
+	}
+
+	/* '+' is a space only in the query */
+	if out, _ := urlDecode([]byte("/a+b?q=c+d"), 5); string(out) != "/a+b?q=c d" {
+		t.Errorf("expect a literal '+' in the path, got %q", out)
+	}
+	if out, offsets := urlDecode([]byte("/a+b"), -1); string(out) != "/a+b" || offsets != nil {
+		t.Errorf("expect nothing decoded, got %q %v", out, offsets)
+	}
+	out, offsets := urlDecode([]byte("x%3Cy"), -1)
+	if string(out) != "x<y" || rawOffset(offsets, 1) != 1 || rawOffset(offsets, 2) != 4 || rawOffset(offsets, 3) != 5 {
+		t.Errorf("unexpected offsets of %q: %v", out, offsets)
+	}
+}
+
+func TestFindBase64(t *testing.T) {
+	/* PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg== is <script>alert(1)</script> */
+	segments := findBase64([]byte("token=PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==&x=1"), 16)
+	if len(segments) != 1 || string(segments[0].decoded) != "<script>alert(1)</script>" || segments[0].offset != 6 {
+		t.Fatalf("unexpected segments: %+v", segments)
+	}
+	if string(segments[0].encoded) != "PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==" {
+		t.Errorf("unexpected encoded run: %s", segments[0].encoded)
+	}
+
+	/* url safe alphabet, unpadded */
+	if segments := findBase64([]byte("PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg"), 16); len(segments) != 1 {
+		t.Errorf("expect unpadded run decoded, got %+v", segments)
+	}
+
+	for _, in := range []string{
+		"/api/v1/users/profile/settings",
+		"internationalization is long",
+		"short=YWJj",
+	} {
+		if segments := findBase64([]byte(in), 16); len(segments) != 0 {
+			t.Errorf("expect no base64 in %q, got %+v", in, segments)
+		}
+	}
+}
+
+func TestSanitizeUTF8(t *testing.T) {
+	out, offsets := sanitizeUTF8([]byte("a\xffb\xe4\xbd\xa0"))
+	if string(out) != "a\uFFFDb你" {
+		t.Errorf("sanitizeUTF8 got %q", out)
+	}
+	if rawOffset(offsets, 4) != 2 || rawOffset(offsets, uint64(len(out))) != 6 {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+}
+
+func TestNormalizeDoubleURL(t *testing.T) {
+	Normalize = map[string]bool{NormalizeDoubleURL: true}
+	defer func() { Normalize = nil }()
+	if out, _ := normalizeInput(scanPart{data: []byte("%253Cscript%253E")}); string(out) != "<script>" {
+		t.Errorf("double decode got %q", out)
+	}
+}
+
+// test lowercase keeps offsets and leaves runes which change length alone
+func TestLowercase(t *testing.T) {
+	for in, want := range map[string]string{
+		"<SCRIPT>Alert(1)": "<script>alert(1)",
+		"ÀÉ\xffZ":          "àé\xffz",
+		"İx":               "İx", /* lower case of U+0130 is longer */
+	} {
+		if out := string(lowercase([]byte(in))); out != want {
+			t.Errorf("lowercase(%q) = %q, want %q", in, out, want)
+		}
+	}
+}
+
+// test case sensitive rules match lowercased input while the original case is reported
+func TestNormalizeLowercase(t *testing.T) {
+	path := writeRules(t, "1\t<script\txss\tl\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	Normalize = map[string]bool{NormalizeLowercase: true}
+	defer func() { Normalize = nil }()
+
+	matchResps, err := scanRequestPart(scanPart{target: "body", data: []byte("x=<ScRiPt>")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 1 || matchResps[0].From != 2 || matchResps[0].Matched != "<ScRiPt" || matchResps[0].Normalized {
+		t.Errorf("unexpected matches %+v", matchResps)
+	}
+}
+
+// test '+' is a space only in query and form values and matches report the bytes sent
+func TestNormalizeURL(t *testing.T) {
+	path := writeRules(t, "1\t<script\txss\tl\n2\ta b\tspace\tl\n")
+	defer os.Remove(path)
+	if err := buildScratch(path); err != nil {
+		t.Fatal(err)
+	}
+	Normalize = map[string]bool{NormalizeURL: true}
+	ScanTargets = map[string]bool{TargetURI: true, TargetBody: true}
+	defer func() { Normalize, ScanTargets = nil, nil }()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/a+b?q=%3Cscript%3E&r=a+b")
+	matchResps, err := scanParts(requestParts(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matchResps) != 2 {
+		t.Fatalf("expect <script and the a b of the query, got %+v", matchResps)
+	}
+	xss, space := matchResps[0], matchResps[1]
+	if xss.Id != 1 || xss.From != 7 || xss.To != 14 || xss.Matched != "%3Cscript" || !xss.Normalized {
+		t.Errorf("expect the encoded text reported at decoded offsets, got %+v", xss)
+	}
+	if space.Id != 2 || space.Matched != "a+b" || space.From != 18 {
+		t.Errorf("expect the query a+b matched, got %+v", space)
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/a+b")
+	ctx.Request.Header.SetContentType("application/x-www-form-urlencoded")
+	ctx.Request.SetBodyString("r=a+b")
+	if matchResps, _ := scanParts(requestParts(ctx)); len(matchResps) != 1 || matchResps[0].Target != TargetBody {
+		t.Errorf("expect only the form body a+b matched, got %+v", matchResps)
+	}
+}
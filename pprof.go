@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+/* admin address serving net/http/pprof, off when empty, see --pprof */
+var PprofAddr string
+
+// pprof handlers on their own mux, the ones the package registers on
+// http.DefaultServeMux are never served
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serve pprof on addr apart from the waf port, so profiles are never public.
+// Mutex and block profiles are sampled too, they show scratch pool contention.
+func servePprof(addr string) {
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(int(1e6)) /* one event per ms blocked */
+	log.Info(fmt.Sprintf("pprof on http://%s/debug/pprof/", addr))
+	if err := http.ListenAndServe(addr, pprofMux()); err != nil {
+		log.Error(fmt.Sprintf("pprof server: %s", err))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/valyala/fasthttp"
+	"sync"
+	"time"
+)
+
+/* idle buckets are swept this often */
+const rateEvictInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// token bucket per client ip, refilled at rate tokens per second up to burst
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// take a token of key, false when its bucket is empty
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drop buckets idle long enough to be full again, they are the same as new ones
+func (l *rateLimiter) evict(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	l.Lock()
+	defer l.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// reject clients over --rate-limit with 429 before h runs
+func rateLimit(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if RateLimit <= 0 {
+		return h
+	}
+	limiter := newRateLimiter(RateLimit, RateBurst)
+	go func() {
+		for now := range time.Tick(rateEvictInterval) {
+			limiter.evict(now)
+		}
+	}()
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if !limiter.allow(clientIP(ctx).String(), time.Now()) {
+			writeJSON(ctx, fasthttp.StatusTooManyRequests, Response{Errno: -4, Msg: "rate limit exceeded"})
+			return
+		}
+		h(ctx)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow("1.2.3.4", now) {
+			t.Fatalf("request %d within burst rejected", i)
+		}
+	}
+	if l.allow("1.2.3.4", now) {
+		t.Error("expect request over burst rejected")
+	}
+	if !l.allow("5.6.7.8", now) {
+		t.Error("expect other client allowed")
+	}
+	if !l.allow("1.2.3.4", now.Add(500*time.Millisecond)) {
+		t.Error("expect a token refilled after 1/rate")
+	}
+
+	/* buckets refill in burst/rate = 1.5s */
+	l.evict(now.Add(1500 * time.Millisecond))
+	if len(l.buckets) != 1 {
+		t.Errorf("expect only the refilling bucket kept, got %d", len(l.buckets))
+	}
+	l.evict(now.Add(2 * time.Second))
+	if len(l.buckets) != 0 {
+		t.Errorf("expect idle buckets evicted, got %d", len(l.buckets))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/valyala/fasthttp" /* http parse lib */
+)
+
+/* incoming ids longer than this or with unprintable bytes are replaced */
+const maxRequestIDLen = 128
+
+// id of the request from X-Request-ID, generated when missing or invalid,
+// the same id is returned for the whole life of ctx
+func requestID(ctx *fasthttp.RequestCtx) string {
+	if id, ok := ctx.UserValue("request_id").(string); ok {
+		return id
+	}
+	id := string(ctx.Request.Header.Peek("X-Request-ID"))
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	ctx.SetUserValue("request_id", id)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// 16 random bytes as hex
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/valyala/fasthttp" /* http parse lib */
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxTrackedLine  = 8192 /* longest request or header line followed, fasthttp refuses longer headers by default */
+	maxPendingLines = 64   /* request lines kept ahead of the handler, more are only pipelined */
+)
+
+// listener whose connections keep the raw request lines, fasthttp parses the
+// protocol of a request line into IsHTTP11 only
+type requestLineListener struct {
+	net.Listener
+}
+
+func (l requestLineListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	/* fasthttp tells TLS connections by these methods, see RequestCtx.IsTLS */
+	if tc, ok := c.(*tls.Conn); ok {
+		return &requestLineTLSConn{&requestLineConn{Conn: c}, tc}, nil
+	}
+	return &requestLineConn{Conn: c}, nil
+}
+
+/* states of requestLineConn following the requests read from it */
+const (
+	stateLine      = iota /* request line, blank lines before it are skipped */
+	stateHeaders          /* header lines up to the blank one */
+	stateBody             /* skipping a Content-Length body */
+	stateChunkSize        /* size line of a chunk */
+	stateChunk            /* skipping chunk data and its CRLF */
+	stateTrailers         /* trailer lines up to the blank one after the last chunk */
+	stateLost             /* framing not understood, nothing recorded any more */
+)
+
+// connection recording the request line of every request read from it, in the
+// order fasthttp reads them, so the n-th line is the one of ConnRequestNum n.
+// The bodies are skipped by Content-Length and chunked encoding as fasthttp does.
+type requestLineConn struct {
+	net.Conn
+
+	sync.Mutex
+	state     int
+	line      []byte
+	remaining int64  /* body or chunk bytes left to skip */
+	length    int64  /* Content-Length of the current request */
+	chunked   bool   /* Transfer-Encoding other than identity */
+	parsed    uint64 /* request lines seen */
+	first     uint64 /* request number of lines[0] */
+	lines     [][]byte
+}
+
+func (c *requestLineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.Lock()
+		c.feed(b[:n])
+		c.Unlock()
+	}
+	return n, err
+}
+
+// raw request line of request n of the connection, the ones before are dropped
+func (c *requestLineConn) requestLine(n uint64) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.lines) > 0 && c.first < n {
+		c.lines = c.lines[1:]
+		c.first++
+	}
+	if len(c.lines) == 0 || c.first != n {
+		return nil, false
+	}
+	return c.lines[0], true
+}
+
+func (c *requestLineConn) feed(data []byte) {
+	for len(data) > 0 && c.state != stateLost {
+		if c.state == stateBody || c.state == stateChunk {
+			skip := int64(len(data))
+			if skip > c.remaining {
+				skip = c.remaining
+			}
+			data = data[skip:]
+			if c.remaining -= skip; c.remaining == 0 {
+				if c.state == stateBody {
+					c.state = stateLine
+				} else {
+					c.state = stateChunkSize
+				}
+			}
+			continue
+		}
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.line = append(c.line, data...)
+			data = nil
+		} else {
+			c.line = append(c.line, data[:i]...)
+			data = data[i+1:]
+		}
+		if len(c.line) > maxTrackedLine {
+			c.lost()
+			return
+		}
+		if i >= 0 {
+			c.endLine(bytes.TrimSuffix(c.line, []byte("\r")))
+			c.line = c.line[:0]
+		}
+	}
+}
+
+func (c *requestLineConn) endLine(line []byte) {
+	switch c.state {
+	case stateLine:
+		if len(line) == 0 {
+			return
+		}
+		if len(c.lines) == 0 {
+			c.first = c.parsed + 1
+		}
+		c.parsed++
+		c.lines = append(c.lines, append([]byte(nil), line...))
+		/* lines of requests whose handler never asked for them */
+		if len(c.lines) > maxPendingLines {
+			c.lines = c.lines[1:]
+			c.first++
+		}
+		c.length, c.chunked = 0, false
+		c.state = stateHeaders
+	case stateHeaders:
+		if len(line) == 0 {
+			switch {
+			case c.chunked:
+				c.state = stateChunkSize
+			case c.length > 0:
+				c.state, c.remaining = stateBody, c.length
+			default:
+				c.state = stateLine
+			}
+			return
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			return
+		}
+		name, value := bytes.TrimSpace(line[:i]), bytes.TrimSpace(line[i+1:])
+		switch {
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			c.chunked = !bytes.Equal(value, []byte("identity"))
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			length, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil || length < 0 {
+				/* fasthttp closes the connection */
+				c.lost()
+				return
+			}
+			c.length = length
+		}
+	case stateChunkSize:
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		if err != nil || size < 0 {
+			c.lost()
+			return
+		}
+		if size == 0 {
+			c.state = stateTrailers
+			return
+		}
+		c.state, c.remaining = stateChunk, size+2 /* data and its CRLF */
+	case stateTrailers:
+		if len(line) == 0 {
+			c.state = stateLine
+		}
+	}
+}
+
+func (c *requestLineConn) lost() {
+	c.state = stateLost
+	c.line = nil
+}
+
+type requestLineTLSConn struct {
+	*requestLineConn
+	tls *tls.Conn
+}
+
+func (c *requestLineTLSConn) Handshake() error { return c.tls.Handshake() }
+
+func (c *requestLineTLSConn) ConnectionState() tls.ConnectionState { return c.tls.ConnectionState() }
+
+// the raw request line of the request, nil when it wasn't read through a requestLineListener
+func rawRequestLine(ctx *fasthttp.RequestCtx) []byte {
+	var c *requestLineConn
+	switch conn := ctx.Conn().(type) {
+	case *requestLineConn:
+		c = conn
+	case *requestLineTLSConn:
+		c = conn.requestLineConn
+	default:
+		return nil
+	}
+	line, _ := c.requestLine(ctx.ConnRequestNum())
+	return line
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"testing"
+)
+
+// test request lines are told apart from bodies, fed in any chunk size
+func TestRequestLineConn(t *testing.T) {
+	stream := "GET / HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /p HTTP/1.1\r\ncontent-length: 22\r\n\r\nGET /fake HTTP/6.6\r\n\r\n" +
+		"PUT /c HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n7\r\nGET / X\r\n0\r\nX-Trailer: 1\r\n\r\n" +
+		"\r\nGET /x HTTP/9.9\r\n\r\n"
+	for _, size := range []int{1, 7, len(stream)} {
+		c := &requestLineConn{}
+		for i := 0; i < len(stream); i += size {
+			end := i + size
+			if end > len(stream) {
+				end = len(stream)
+			}
+			c.feed([]byte(stream[i:end]))
+		}
+		for n, want := range []string{"GET / HTTP/1.1", "POST /p HTTP/1.1", "PUT /c HTTP/1.1", "GET /x HTTP/9.9"} {
+			if line, ok := c.requestLine(uint64(n + 1)); !ok || string(line) != want {
+				t.Errorf("chunks of %d: expect request %d line %q, got %q", size, n+1, want, line)
+			}
+		}
+		if _, ok := c.requestLine(5); ok {
+			t.Errorf("chunks of %d: expect 4 requests", size)
+		}
+	}
+}
+
+// test the protocol is scanned as sent, not as fasthttp parsed it
+func TestRequestLineProtocol(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	server := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		parts := requestLineParts(ctx)
+		ctx.SetBody(append(append(parts[1].data, '|'), parts[2].data...))
+	}}
+	go server.Serve(requestLineListener{ln})
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 17\r\n\r\nGET /b HTTP/1.1\r\n" +
+		"GET /c HTTP/1.1x\r\nHost: a\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"HTTP/1.1|POST /a HTTP/1.1", "HTTP/1.1x|GET /c HTTP/1.1x"} {
+		var resp fasthttp.Response
+		if err := resp.Read(r); err != nil {
+			t.Fatal(err)
+		}
+		if body := string(resp.Body()); body != want {
+			t.Errorf("expect %q, got %q", want, body)
+		}
+	}
+}
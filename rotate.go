@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* suffix of rotated files, sorts by time */
+const rotateTimeFormat = "20060102-150405"
+
+// rotatingFile is a log file renamed to path.<time> once it reaches maxSize bytes
+// or every interval, keeping at most maxBackups rotated files.
+type rotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64         /* 0 is no size limit */
+	interval   time.Duration /* 0 is no time based rotation */
+	maxBackups int           /* 0 keeps every rotated file */
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// append to path, the size and age of an existing file count
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.openedAt = file, info.Size(), info.ModTime()
+	if info.Size() == 0 {
+		r.openedAt = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if r.size > 0 && (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize || r.interval > 0 && now.Sub(r.openedAt) >= r.interval) {
+		if err := r.rotate(now); err != nil {
+			/* keep writing to the current file rather than losing lines */
+			fmt.Fprintf(os.Stderr, "rotate %s: %s\n", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate(now time.Time) error {
+	backup := r.path + "." + now.Format(rotateTimeFormat)
+	if _, err := os.Stat(backup); err == nil {
+		/* rotated twice within a second */
+		backup = fmt.Sprintf("%s.%d", backup, now.Nanosecond())
+	}
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	r.file.Close()
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// remove the oldest rotated files over maxBackups
+func (r *rotatingFile) prune() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	if len(backups) <= r.maxBackups {
+		return nil
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-r.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.file.Close()
+}
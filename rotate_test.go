@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hwaf-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	r, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := r.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expect 2 backups kept, got %v", backups)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "12345678\n" {
+		t.Errorf("expect a single line in the current file, got %q", data)
+	}
+
+	r.interval, r.maxSize = time.Nanosecond, 0
+	r.openedAt = time.Now().Add(-time.Second)
+	r.Write([]byte("next\n"))
+	if data, _ := ioutil.ReadFile(path); string(data) != "next\n" {
+		t.Errorf("expect a time based rotation, got %q", data)
+	}
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"  /* structured logger lib */
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"gopkg.in/yaml.v2"                /* yaml lib */
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// build scratch for regex files and swap it in, the serving rules are kept on error.
+// A panic while building is turned into an error, so a bad reload can't take the server down.
+func buildScratch(filepaths ...string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("build rules: %v", r)
+		}
+	}()
+	e, err := compileEngine(DbCache, filepaths...)
+	if err != nil {
+		return err
+	}
+	swapEngine(e)
+	return nil
+}
+
+/* exit codes of rules failing to load, so init containers and systemd tell them apart */
+const (
+	ExitRulesNotFound = 3 /* a --filepath does not exist */
+	ExitRulesEmpty    = 4 /* the files are empty or blank */
+	ExitRulesSkipped  = 5 /* the files have lines, none of them is a rule */
+	ExitRulesInvalid  = 6 /* a rule does not parse or compile */
+)
+
+// rules failed to load for a reason with its own exit code
+type rulesError struct {
+	code int
+	err  error
+}
+
+func (e *rulesError) Error() string {
+	return e.err.Error()
+}
+
+// process exit code for the error a command failed with
+func exitCode(err error) int {
+	if e, ok := err.(*rulesError); ok {
+		return e.code
+	}
+	return 1
+}
+
+// true when none of the files has anything but whitespace, only asked once no
+// rule was loaded to tell empty files from files whose every line was skipped
+func rulesFilesEmpty(filepaths []string) bool {
+	for _, path := range filepaths {
+		file, err := openRuleFile(path)
+		if err != nil {
+			return false
+		}
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || len(bytes.TrimSpace(content)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// expand glob patterns of --filepath into the files they match, sorted so the load
+// order doesn't depend on the file system. Ids assigned to files without id column
+// run on from the id-less files before them, so a new such file shifts the ids of
+// those sorted after it. Stdin, urls and plain paths are kept as they are.
+func expandRulePaths(filepaths []string) ([]string, error) {
+	expanded := []string{}
+	seen := make(map[string]bool)
+	for _, path := range filepaths {
+		matches := []string{path}
+		if path != StdinPath && !strings.Contains(path, "://") && strings.ContainsAny(path, "*?[") {
+			var err error
+			matches, err = filepath.Glob(path)
+			if err != nil {
+				return nil, &rulesError{ExitRulesInvalid, fmt.Errorf("invalid --filepath glob %s: %s", path, err)}
+			}
+			if len(matches) <= 0 {
+				return nil, &rulesError{ExitRulesNotFound, fmt.Errorf("rule file not found: --filepath %s matches no file", path)}
+			}
+			sort.Strings(matches)
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				expanded = append(expanded, match)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// compile rules of all files into one database, in block mode via the cache file
+// dbCache unless it is empty.
+func compileEngine(dbCache string, filepaths ...string) (*engine, error) {
+	//flags := Flag
+	//flags := hyperscan.Caseless | hyperscan.Utf8Mode
+	start := time.Now()
+	flags, err := parseCompileFlag(Flag)
+	if err != nil {
+		return nil, err
+	}
+	/* globs are expanded on every load, so a reload picks up files dropped into the directory */
+	filepaths, err = expandRulePaths(filepaths)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []*hyperscan.Pattern{}
+	regexMap := make(map[int]RegexLine)
+	ruleFiles := make(map[int]string) /* rule id => file which defines it */
+	autoIds := 0                      /* lines of the files without id column so far */
+	for _, path := range filepaths {
+		filePatterns, regexLines, err := readRegexFile(path, flags, &autoIds)
+		if os.IsNotExist(err) {
+			return nil, &rulesError{ExitRulesNotFound, fmt.Errorf("rule file not found: %s", err)}
+		}
+		if err != nil {
+			return nil, &rulesError{ExitRulesInvalid, err}
+		}
+		for id, regexLine := range regexLines {
+			if f, ok := ruleFiles[id]; ok {
+				return nil, &rulesError{ExitRulesInvalid, fmt.Errorf("regex id %d in %s is already defined in %s", id, path, f)}
+			}
+			ruleFiles[id] = path
+			regexMap[id] = regexLine
+		}
+		patterns = append(patterns, filePatterns...)
+	}
+
+	if len(patterns) <= 0 {
+		if rulesFilesEmpty(filepaths) {
+			return nil, &rulesError{ExitRulesEmpty, fmt.Errorf("Empty regex, %s contains no rules", strings.Join(filepaths, ", "))}
+		}
+		return nil, &rulesError{ExitRulesSkipped, fmt.Errorf("Empty regex, every line of %s was skipped as comment, short or invalid", strings.Join(filepaths, ", "))}
+	}
+	log.Info(fmt.Sprintf("regex file number: %d, line number: %d", len(filepaths), len(patterns)))
+	log.Info("Start Building, please wait...")
+	e := &engine{mode: Mode, regexMap: regexMap, filepaths: filepaths, flag: Flag}
+	for _, pattern := range patterns {
+		if pattern.Flags&hyperscan.Utf8Mode != 0 {
+			e.utf8 = true
+		}
+	}
+	for _, regexLine := range regexMap {
+		if regexLine.Action == ActionAllow {
+			e.allows = true
+		}
+	}
+	exts := patternExts(patterns, regexMap)
+	switch Mode {
+	case ModeStream:
+		e.stream, err = newStreamDatabase(patterns, exts)
+		e.db = e.stream
+	case ModeVectored:
+		e.vectored, err = newVectoredDatabase(patterns, exts)
+		e.db = e.vectored
+	default:
+		e.mode = ModeBlock
+		e.block, err = compileBlockDatabase(dbCache, patterns, exts)
+		e.db = e.block
+	}
+	if err != nil {
+		return nil, &rulesError{ExitRulesInvalid, fmt.Errorf("compile rules: %s", err)}
+	}
+
+	e.scratches, err = newScratchPool(e.db, PoolSize)
+	if err != nil {
+		e.db.Close()
+		return nil, err
+	}
+
+	if CacheSize > 0 {
+		e.cache = newResultCache(CacheSize)
+	}
+	e.measure()
+	e.warmup()
+	e.builtAt = time.Now()
+	e.buildTime = e.builtAt.Sub(start)
+	log.Info(fmt.Sprintf("Built %d rules in %s, database %d bytes, scratch %d bytes", len(regexMap), e.buildTime, e.dbSize, e.scratchSize))
+	return e, nil
+}
+
+/* bounded repetitions above this are expanded by the compiler and get expensive */
+const maxCheapRepeat = 1000
+
+var repeatRe = regexp.MustCompile(`\{(\d+)(,(\d*))?\}`)
+
+// known expensive constructs of expr, they compile but cost memory or scan time
+func exprWarnings(expr string) []string {
+	var warnings []string
+	unbounded := strings.Count(expr, ".*") + strings.Count(expr, ".+")
+	if strings.HasPrefix(expr, ".*") {
+		warnings = append(warnings, "leading .* is redundant, matches are found anywhere in the input anyway")
+	}
+	if unbounded > 1 {
+		warnings = append(warnings, fmt.Sprintf("%d unbounded .* or .+ repetitions, they multiply the match states", unbounded))
+	}
+	for _, m := range repeatRe.FindAllStringSubmatch(expr, -1) {
+		for _, bound := range []string{m[1], m[3]} {
+			if n, err := strconv.Atoi(bound); err == nil && n > maxCheapRepeat {
+				warnings = append(warnings, fmt.Sprintf("large bounded repetition %s", m[0]))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// diagnostics of what hyperscan reports about a compiled expression,
+// it has no warnings of its own, a pattern either compiles or fails
+func infoWarnings(info *hyperscan.ExprInfo) []string {
+	var warnings []string
+	if info.MinWidth == 0 {
+		warnings = append(warnings, "can match the empty string, it is reported at every offset, drop those with --skip-empty-matches and the l flag")
+	}
+	if info.OnlyAtEndOfData {
+		warnings = append(warnings, "only matches at end of data, a stream scan reports it on close")
+	}
+	if info.ReturnUnordered {
+		warnings = append(warnings, "matches may be reported out of order")
+	}
+	return warnings
+}
+
+// data of the rule asks for anchoring, i.e. it is a json object with "anchor": true
+func ruleAnchored(data string) bool {
+	var v struct {
+		Anchor bool `json:"anchor"`
+	}
+	return json.Unmarshal([]byte(data), &v) == nil && v.Anchor
+}
+
+// anchor expr to the start of the input. Hyperscan then only tries the match at
+// offset 0 instead of at every byte, which is much cheaper for long inputs, but the
+// rule no longer matches a payload in the middle of a part, e.g. behind a prefix.
+func anchorExpr(expr string) string {
+	if strings.HasPrefix(expr, "^") || strings.HasPrefix(expr, `\A`) {
+		return expr
+	}
+	return "^(?:" + expr + ")"
+}
+
+/* logical combination flags of hyperscan >= 5.0, unknown to the vendored gohs */
+const (
+	Combination hyperscan.CompileFlag = 512  /* HS_FLAG_COMBINATION, expression is a logic of rule ids */
+	Quiet       hyperscan.CompileFlag = 1024 /* HS_FLAG_QUIET, don't report matches, only feed combinations */
+)
+
+var extraFlags = map[rune]hyperscan.CompileFlag{'c': Combination, 'q': Quiet}
+
+// hyperscan.ParseCompileFlag plus c for Combination and q for Quiet
+func parseCompileFlag(s string) (hyperscan.CompileFlag, error) {
+	var flags hyperscan.CompileFlag
+	rest := ""
+	for _, c := range s {
+		if flag, ok := extraFlags[c]; ok {
+			flags |= flag
+		} else {
+			rest += string(c)
+		}
+	}
+	parsed, err := hyperscan.ParseCompileFlag(rest)
+	if err != nil {
+		return 0, err
+	}
+	return flags | parsed, nil
+}
+
+/* listed in flag errors, the gohs ones plus c and q */
+const compileFlagsHelp = "i (caseless), s (dot all), m (multi line), o (single match), e (allow empty), u (utf-8), " +
+	"p (unicode property), f (prefilter), l (leftmost start of match), c (combination), q (quiet)"
+
+// check --flag before any rule file is read
+func validateFlag(s string) error {
+	if _, err := parseCompileFlag(s); err != nil {
+		return fmt.Errorf("invalid --flag %q: %s, valid flags are %s", s, err, compileFlagsHelp)
+	}
+	return nil
+}
+
+// string form of flags, including c and q
+func formatCompileFlag(flags hyperscan.CompileFlag) string {
+	values := strings.Split((flags &^ (Combination | Quiet)).String(), "")
+	for c, flag := range extraFlags {
+		if flags&flag == flag {
+			values = append(values, string(c))
+		}
+	}
+	sort.Strings(values)
+	return strings.Join(values, "")
+}
+
+/* rule actions, only block makes the handler respond 403 */
+const (
+	ActionBlock     = "block"
+	ActionLog       = "log"
+	ActionChallenge = "challenge"
+
+	/* exclusion rule, suppresses the matches of other rules overlapping its own */
+	ActionAllow = "allow"
+)
+
+/* rule severities, in ascending order */
+var severities = []string{"info", "low", "medium", "high", "critical"}
+
+/* extended parameter column keys, in the order they are formatted */
+var extParams = []struct {
+	name string
+	flag hyperscan.ExtFlag
+}{
+	{"min_offset", hyperscan.MinOffset},
+	{"max_offset", hyperscan.MaxOffset},
+	{"min_length", hyperscan.MinLength},
+	{"edit_distance", hyperscan.EditDistance},
+}
+
+// parse extended parameters like "min_offset=10,edit_distance=1", nil for an empty column
+func parseExprExt(s string) (*hyperscan.ExprExt, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	ext := &hyperscan.ExprExt{}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid extended parameter %q, expect name=value", kv)
+		}
+		name := strings.TrimSpace(kv[:i])
+		value, err := strconv.ParseUint(strings.TrimSpace(kv[i+1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extended parameter %q: %s", kv, err)
+		}
+		switch name {
+		case "min_offset":
+			ext.MinOffset = value
+		case "max_offset":
+			ext.MaxOffset = value
+		case "min_length":
+			ext.MinLength = value
+		case "edit_distance":
+			ext.EditDistance = uint(value)
+		default:
+			return nil, fmt.Errorf("unknown extended parameter %s", name)
+		}
+		for _, p := range extParams {
+			if p.name == name {
+				ext.Flags |= p.flag
+			}
+		}
+	}
+	if ext.Flags&hyperscan.MinOffset != 0 && ext.Flags&hyperscan.MaxOffset != 0 && ext.MinOffset > ext.MaxOffset {
+		return nil, fmt.Errorf("min_offset %d is larger than max_offset %d", ext.MinOffset, ext.MaxOffset)
+	}
+	return ext, nil
+}
+
+// extended parameters of patterns by index, from the ext column of their rules,
+// nil when no rule has any so the gohs constructors compile them
+func patternExts(patterns []*hyperscan.Pattern, regexMap map[int]RegexLine) []*hyperscan.ExprExt {
+	var exts []*hyperscan.ExprExt
+	for i, pattern := range patterns {
+		ext, _ := parseExprExt(regexMap[pattern.Id].Ext) /* checked by newRule */
+		if ext == nil {
+			continue
+		}
+		if exts == nil {
+			exts = make([]*hyperscan.ExprExt, len(patterns))
+		}
+		exts[i] = ext
+	}
+	return exts
+}
+
+func newBlockDatabase(patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt) (hyperscan.BlockDatabase, error) {
+	if exts == nil {
+		return hyperscan.NewBlockDatabase(patterns...)
+	}
+	data, err := compileExtMulti(patterns, exts, hyperscan.BlockMode)
+	if err != nil {
+		return nil, err
+	}
+	return hyperscan.UnmarshalBlockDatabase(data)
+}
+
+func newStreamDatabase(patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt) (hyperscan.StreamDatabase, error) {
+	if exts == nil {
+		return hyperscan.NewStreamDatabase(patterns...)
+	}
+	data, err := compileExtMulti(patterns, exts, hyperscan.StreamMode)
+	if err != nil {
+		return nil, err
+	}
+	return hyperscan.UnmarshalStreamDatabase(data)
+}
+
+func newVectoredDatabase(patterns []*hyperscan.Pattern, exts []*hyperscan.ExprExt) (hyperscan.VectoredDatabase, error) {
+	if exts == nil {
+		return hyperscan.NewVectoredDatabase(patterns...)
+	}
+	data, err := compileExtMulti(patterns, exts, hyperscan.VectoredMode)
+	if err != nil {
+		return nil, err
+	}
+	return hyperscan.UnmarshalVectoredDatabase(data)
+}
+
+// format ext back to the column form, empty for nil
+func formatExprExt(ext *hyperscan.ExprExt) string {
+	if ext == nil {
+		return ""
+	}
+	var kvs []string
+	for _, p := range extParams {
+		if ext.Flags&p.flag == 0 {
+			continue
+		}
+		var value uint64
+		switch p.flag {
+		case hyperscan.MinOffset:
+			value = ext.MinOffset
+		case hyperscan.MaxOffset:
+			value = ext.MaxOffset
+		case hyperscan.MinLength:
+			value = ext.MinLength
+		case hyperscan.EditDistance:
+			value = uint64(ext.EditDistance)
+		}
+		kvs = append(kvs, fmt.Sprintf("%s=%d", p.name, value))
+	}
+	return strings.Join(kvs, ",")
+}
+
+// rank of severity, 0 for unset or unknown
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// open a local rule file or fetch an http(s) url with --rules-timeout and --rules-header
+func openRuleFile(path string) (io.ReadCloser, error) {
+	if path == StdinPath {
+		return openStdinRules()
+	}
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return os.Open(path)
+	}
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range RulesHeaders {
+		i := strings.IndexByte(header, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid rules header %q, expect Name: value", header)
+		}
+		req.Header.Set(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+	client := &http.Client{Timeout: RulesTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch %s: %s", path, resp.Status)
+	}
+	log.Info(fmt.Sprintf("fetching rules from %s", path))
+	return resp.Body, nil
+}
+
+/* --filepath reading the rules from stdin */
+const StdinPath = "-"
+
+/* stdin can only be read once, reloads get what was read at startup */
+var (
+	stdinOnce    sync.Once
+	stdinContent []byte
+	stdinErr     error
+	rulesStdin   io.Reader = os.Stdin /* replaced in tests */
+)
+
+func openStdinRules() (io.ReadCloser, error) {
+	stdinOnce.Do(func() {
+		stdinContent, stdinErr = ioutil.ReadAll(rulesStdin)
+	})
+	if stdinErr != nil {
+		return nil, fmt.Errorf("read rules from stdin: %s", stdinErr)
+	}
+	return ioutil.NopCloser(bytes.NewReader(stdinContent)), nil
+}
+
+// one rule as written in a rule file, before validation
+type ruleSpec struct {
+	Id       *int   `json:"id" yaml:"id"`
+	Expr     string `json:"expr" yaml:"expr"`
+	Data     string `json:"data" yaml:"data"`
+	Flags    string `json:"flags" yaml:"flags"`       /* the global --flag when empty */
+	Severity string `json:"severity" yaml:"severity"` /* info, low, medium, high or critical */
+	Action   string `json:"action" yaml:"action"`     /* block when empty */
+	Category string `json:"category" yaml:"category"`
+	Ext      string `json:"ext" yaml:"ext"` /* e.g. min_offset=10,edit_distance=1 */
+}
+
+// read patterns of one regex file, see visitRuleFile for its formats.
+// flags defaults to the global --flag and action to block when the column is absent or empty.
+// path may be an http(s) url, see openRuleFile. autoIds is passed on to visitRuleFile.
+func readRegexFile(path string, flags hyperscan.CompileFlag, autoIds *int) ([]*hyperscan.Pattern, map[int]RegexLine, error) {
+	patterns := []*hyperscan.Pattern{}
+	regexLines := make(map[int]RegexLine)
+	defined := make(map[int]string) /* rule id => pos which defines it */
+	add := func(pos string, spec ruleSpec, err error) error {
+		if err != nil {
+			return err
+		}
+		pattern, regexLine, err := newRule(pos, spec, flags)
+		if err == nil {
+			/* both would be compiled while only one is reported, keep the first */
+			if first, ok := defined[*spec.Id]; ok {
+				err = fmt.Errorf("%s: regex id %d is already defined at %s", pos, *spec.Id, first)
+			}
+		}
+		if err != nil {
+			if _, noId := err.(*noIdError); SkipInvalid && !noId {
+				log.Warn(fmt.Sprintf("skip invalid rule, %s", err))
+				return nil
+			}
+			return err
+		}
+		patterns = append(patterns, pattern)
+		regexLines[*spec.Id] = regexLine
+		defined[*spec.Id] = pos
+		return nil
+	}
+	skip := func(pos, line, reason string) {
+		log.Info(fmt.Sprintf("%s, skip line: [%s]", reason, line))
+	}
+	if err := visitRuleFile(path, autoIds, add, skip); err != nil {
+		return nil, nil, err
+	}
+	return patterns, regexLines, nil
+}
+
+// walk the rules of one file, by extension a yaml or json list of rules,
+// otherwise a tab separated file with a rule per line:
+//
+//	id \t regex \t data [\t flags [\t severity [\t action [\t category [\t ext]]]]]
+//
+// visit gets each rule with its position, or the error of a line without a valid id.
+// skip gets each tsv line which is no rule, with the reason; blank lines are not passed.
+// A tsv file without id column is numbered by line after the *autoIds lines of the
+// earlier such files of the load, and adds its own lines to it.
+func visitRuleFile(path string, autoIds *int, visit func(pos string, spec ruleSpec, err error) error, skip func(pos, line, reason string)) error {
+	file, err := openRuleFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if format := ruleFileFormat(path); format != "tsv" {
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		var specs []ruleSpec
+		if format == "json" {
+			err = json.Unmarshal(content, &specs)
+		} else {
+			err = yaml.Unmarshal(content, &specs)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		for i, spec := range specs {
+			if err := visit(fmt.Sprintf("%s: rule %d", path, i+1), spec, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lineNo := 0
+	autoId, detected := false, false /* decided by the first rule line, see below */
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		lineNo++
+		log.Debug(scanner.Text())
+		line := scanner.Text()
+		pos := fmt.Sprintf("%s:%d", path, lineNo)
+
+		// blank or whitespace only line, skip silently
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// line start with #, skip
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			skip(pos, line, "line start with #")
+			continue
+		}
+		s := strings.Split(line, "\t")
+
+		// no integer id in the first column of the first rule, the file only has expr, data, ...
+		// and rules are numbered by line
+		if !detected && len(s) >= 2 {
+			_, err := strconv.Atoi(s[0])
+			autoId, detected = err != nil, true
+			if autoId {
+				log.Info(fmt.Sprintf("%s: first column is no regex id, assign ids by line number from %d", path, *autoIds+1))
+			}
+		}
+		if autoId {
+			s = append([]string{strconv.Itoa(*autoIds + lineNo)}, s...)
+		}
+		s = stripComment(s)
+
+		// length less than 3, skip
+		if len(s) < 3 {
+			skip(pos, line, fmt.Sprintf("line length less than 3 (%d columns)", len(s)))
+			continue
+		}
+
+		/* id */
+		id, err := strconv.Atoi(s[0])
+		if err != nil {
+			if err := visit(pos, ruleSpec{}, fmt.Errorf("%s: invalid regex id %q", pos, s[0])); err != nil {
+				return err
+			}
+			continue
+		}
+
+		/* optional columns are empty when absent */
+		for len(s) < 8 {
+			s = append(s, "")
+		}
+		spec := ruleSpec{Id: &id, Expr: s[1], Data: s[2], Flags: s[3], Severity: s[4], Action: s[5], Category: s[6], Ext: s[7]}
+		if err := visit(pos, spec, nil); err != nil {
+			return err
+		}
+	}
+
+	if autoId {
+		*autoIds += lineNo
+	}
+	return scanner.Err()
+}
+
+// cut a trailing comment off the columns of a rule line: a column after the expr
+// starting with # begins it. Id and expr are never cut, so # in a regex is kept;
+// a later column really starting with # is written \#.
+func stripComment(s []string) []string {
+	for i := 2; i < len(s); i++ {
+		field := strings.TrimLeft(s[i], " ")
+		if strings.HasPrefix(field, "#") {
+			return s[:i]
+		}
+		if strings.HasPrefix(field, "\\#") {
+			s[i] = strings.Replace(s[i], "\\#", "#", 1)
+		}
+	}
+	return s
+}
+
+// a structured rule without id, never skipped by --skip-invalid
+type noIdError struct {
+	pos string
+}
+
+func (e *noIdError) Error() string {
+	return fmt.Sprintf("%s: rule without id", e.pos)
+}
+
+// yaml or json by the extension of path, which may be an url, tsv otherwise
+func ruleFileFormat(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 && strings.Contains(path, "://") {
+		path = path[:i]
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return "tsv"
+}
+
+// validate spec found at pos into its pattern and rule
+func newRule(pos string, spec ruleSpec, flags hyperscan.CompileFlag) (*hyperscan.Pattern, RegexLine, error) {
+	if spec.Id == nil {
+		return nil, RegexLine{}, &noIdError{pos: pos}
+	}
+	id := *spec.Id
+
+	/* regex, hyperscan rejects an empty expression */
+	if strings.TrimSpace(spec.Expr) == "" {
+		return nil, RegexLine{}, fmt.Errorf("%s: empty regex of id %d", pos, id)
+	}
+	if MaxExprLen > 0 && len(spec.Expr) > MaxExprLen {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d is %d bytes, over --max-expr-len %d", pos, id, len(spec.Expr), MaxExprLen)
+	}
+	warnings := exprWarnings(spec.Expr)
+	expr := hyperscan.Expression(spec.Expr)
+
+	/* flags, optional */
+	ruleFlags := flags
+	if spec.Flags != "" {
+		var err error
+		ruleFlags, err = parseCompileFlag(spec.Flags)
+		if err != nil {
+			return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: %s", pos, id, err)
+		}
+	}
+
+	/* anchoring, with --anchor and "anchor": true in data */
+	if Anchor && ruleAnchored(spec.Data) {
+		if ruleFlags&Combination != 0 {
+			return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: combination rules can't be anchored", pos, id)
+		}
+		expr = hyperscan.Expression(anchorExpr(string(expr)))
+	}
+
+	/* severity, optional */
+	severity := strings.ToLower(spec.Severity)
+	if severity != "" && severityRank(severity) <= 0 {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: unknown severity %s", pos, id, spec.Severity)
+	}
+
+	/* action, optional */
+	action := strings.ToLower(spec.Action)
+	if action == "" {
+		action = ActionBlock
+	}
+	if action != ActionBlock && action != ActionLog && action != ActionChallenge && action != ActionAllow {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: unknown action %s", pos, id, spec.Action)
+	}
+	/* without the l flag every match starts at 0, an allow match would suppress
+	   any match of the part ending after it, wherever the allowed text is appended */
+	if action == ActionAllow && ruleFlags&hyperscan.SomLeftMost == 0 {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: allow rules need the l flag to know where they start", pos, id)
+	}
+
+	/* category, optional, matches can be filtered by it with ?categories= */
+	category := strings.ToLower(strings.TrimSpace(spec.Category))
+
+	/* extended parameters, optional */
+	ext, err := parseExprExt(spec.Ext)
+	if err != nil {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: %s", pos, id, err)
+	}
+	if ext != nil && ruleFlags&Combination != 0 {
+		return nil, RegexLine{}, fmt.Errorf("%s: regex id %d: combination rules take no extended parameters", pos, id)
+	}
+
+	pattern := &hyperscan.Pattern{Expression: expr, Flags: ruleFlags, Id: id}
+	/* compile the expression alone, so a broken line is reported with its position,
+	   hyperscan can't do that for combinations, they are checked by the database build */
+	if ruleFlags&Combination != 0 {
+		log.Debug(fmt.Sprintf("%s: combination rule %d: %s", pos, id, expr))
+	} else if info, err := pattern.Info(); err != nil {
+		return nil, RegexLine{}, fmt.Errorf("%s: invalid regex %q: %s", pos, expr, err)
+	} else {
+		warnings = append(warnings, infoWarnings(info)...)
+	}
+	for _, w := range warnings {
+		log.Warn(fmt.Sprintf("%s: regex id %d: %s", pos, id, w))
+	}
+	return pattern, RegexLine{Expr: string(expr), Data: spec.Data, Flags: formatCompileFlag(ruleFlags), Severity: severity, Action: action, Category: category, Ext: formatExprExt(ext), Warnings: warnings}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// ruleset is a named set of rule files with its own database and scratches,
+// requests are sent to it by path prefix, see --ruleset and --route.
+type ruleset struct {
+	name      string
+	filepaths []string
+	engine    atomic.Value /* *engine, swapped on reload */
+}
+
+/* requests whose path starts with prefix are scanned by ruleset */
+type route struct {
+	prefix  []byte
+	ruleset *ruleset
+}
+
+var (
+	Rulesets map[string]*ruleset
+	Routes   []route /* longest prefix first */
+)
+
+// parse --ruleset name=file, repeating a name adds another file to it
+func parseRulesets(specs []string) (map[string]*ruleset, error) {
+	rulesets := make(map[string]*ruleset)
+	for _, spec := range specs {
+		i := strings.IndexByte(spec, '=')
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("invalid ruleset %q, expect name=file", spec)
+		}
+		name, path := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		rs, ok := rulesets[name]
+		if !ok {
+			rs = &ruleset{name: name}
+			rulesets[name] = rs
+		}
+		rs.filepaths = append(rs.filepaths, path)
+	}
+	return rulesets, nil
+}
+
+// parse --route /prefix=name, name must be a ruleset
+func parseRoutes(specs []string, rulesets map[string]*ruleset) ([]route, error) {
+	var routes []route
+	for _, spec := range specs {
+		i := strings.LastIndexByte(spec, '=')
+		if i <= 0 || i == len(spec)-1 {
+			return nil, fmt.Errorf("invalid route %q, expect /prefix=ruleset", spec)
+		}
+		prefix, name := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		rs, ok := rulesets[name]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown ruleset %s", prefix, name)
+		}
+		routes = append(routes, route{prefix: []byte(prefix), ruleset: rs})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes, nil
+}
+
+// the --db-cache file of the ruleset, next to the one of the --filepath rules
+func (rs *ruleset) dbCache() string {
+	if DbCache == "" {
+		return ""
+	}
+	return DbCache + "." + rs.name
+}
+
+// build every named ruleset, one that fails keeps serving its old rules
+func buildRulesets() error {
+	var failed []string
+	for name, rs := range Rulesets {
+		e, err := compileEngine(rs.dbCache(), rs.filepaths...)
+		if err != nil {
+			log.Error(fmt.Sprintf("build ruleset %s: %s", name, err))
+			failed = append(failed, name)
+			continue
+		}
+		swapInto(&rs.engine, e)
+		log.Info(fmt.Sprintf("ruleset %s: %d rules", name, len(e.regexMap)))
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("build rulesets failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// engine serving path, the ruleset of the longest matching route or the --filepath rules
+func routeEngine(path []byte) *atomic.Value {
+	for _, r := range Routes {
+		if bytes.HasPrefix(path, r.prefix) {
+			return &r.ruleset.engine
+		}
+	}
+	return &Engine
+}
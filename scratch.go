@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+)
+
+// scratchPool hands out clones of a prototype scratch, one per concurrent scan.
+// Scratch space lives in C memory, so idle scratches are kept in a bounded free
+// list instead of a sync.Pool, which may drop them on GC without calling Free.
+type scratchPool struct {
+	proto *hyperscan.Scratch
+	free  chan *hyperscan.Scratch
+	sem   chan struct{} /* limits how many scratches exist at once */
+}
+
+/* replaced in tests to simulate allocation failure */
+var newScratch = hyperscan.NewScratch
+
+// allocate the prototype scratch for db, clones are created lazily up to size
+func newScratchPool(db hyperscan.Database, size int) (*scratchPool, error) {
+	if size <= 0 {
+		size = 1
+	}
+	proto, err := newScratch(db)
+	if err != nil {
+		return nil, err
+	}
+	return &scratchPool{
+		proto: proto,
+		free:  make(chan *hyperscan.Scratch, size),
+		sem:   make(chan struct{}, size),
+	}, nil
+}
+
+// Get returns an idle scratch, or clones a new one while under the ceiling.
+// It blocks when all scratches are in use.
+func (p *scratchPool) Get() (*hyperscan.Scratch, error) {
+	p.sem <- struct{}{}
+	select {
+	case s := <-p.free:
+		return s, nil
+	default:
+	}
+	s, err := p.proto.Clone()
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put gives a scratch obtained from Get back to the pool.
+func (p *scratchPool) Put(s *hyperscan.Scratch) {
+	p.free <- s
+	<-p.sem
+}
+
+// Close frees idle scratches and the prototype, all scratches must have been put back.
+func (p *scratchPool) Close() {
+	for {
+		select {
+		case s := <-p.free:
+			s.Free()
+		default:
+			p.proto.Free()
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	/* number of requests being served, reported when draining on shutdown */
+	activeRequests int64
+
+	/* *tls.Certificate in use, replaced on SIGHUP */
+	certificate atomic.Value
+
+	/* a slot per running scan, --max-concurrency sized, nil means no limit */
+	scanSlots chan struct{}
+)
+
+// load --tls-cert and --tls-key, the served certificate is kept on error
+func loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(TLSCert, TLSKey)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+// server of h with the connection timeouts and limits of the flags,
+// tight ones keep slow clients from holding connections open
+func newServer(h fasthttp.RequestHandler) *fasthttp.Server {
+	return &fasthttp.Server{
+		Handler:       h,
+		Name:          "hwaf",
+		ReadTimeout:   ReadTimeout,
+		WriteTimeout:  WriteTimeout,
+		IdleTimeout:   IdleTimeout,
+		MaxConnsPerIP: MaxConnsPerIP,
+	}
+}
+
+// serve plain http on addr, unlike server.ListenAndServe this listens on
+// IPv6 too when --host is an IPv6 address or "::"
+func serve(server *fasthttp.Server, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(scanListener(ln))
+}
+
+// serve TLS on addr, the certificate is looked up per handshake so it can be reloaded
+func serveTLS(server *fasthttp.Server, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificate.Load().(*tls.Certificate), nil
+		},
+	}
+	return server.Serve(scanListener(tls.NewListener(ln, config)))
+}
+
+// ln keeping the raw request lines when they are scanned, see --scan-request-line
+func scanListener(ln net.Listener) net.Listener {
+	if ScanTargets[TargetRequestLine] {
+		return requestLineListener{ln}
+	}
+	return ln
+}
+
+// count active requests around h
+func trackActive(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt64(&activeRequests, 1)
+		defer atomic.AddInt64(&activeRequests, -1)
+		h(ctx)
+	}
+}
+
+// bound scans running at once by --max-concurrency, a request waits at most
+// --queue-timeout for a slot and is rejected with 503 after that
+func limitConcurrency(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if scanSlots == nil {
+			h(ctx)
+			return
+		}
+		select {
+		case scanSlots <- struct{}{}:
+		default:
+			if !waitScanSlot(QueueTimeout) {
+				ctx.Response.Header.Set("Retry-After", "1")
+				writeJSON(ctx, fasthttp.StatusServiceUnavailable, Response{Errno: -5, Msg: "too many concurrent scans"})
+				return
+			}
+		}
+		defer func() { <-scanSlots }()
+		h(ctx)
+	}
+}
+
+// wait up to timeout for a free scan slot
+func waitScanSlot(timeout time.Duration) bool {
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case scanSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// shutdown server on SIGINT/SIGTERM, waiting at most ShutdownTimeout for active requests.
+// done is closed once the server stopped or the timeout expired.
+func watchShutdown(server *fasthttp.Server, done chan struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+
+	active := atomic.LoadInt64(&activeRequests)
+	log.Info(fmt.Sprintf("%s received, shutting down, draining %d active requests", s, active))
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown()
+	}()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			log.Error(fmt.Sprintf("shutdown error: %s", err))
+		}
+		log.Info(fmt.Sprintf("shutdown complete, drained %d requests", active))
+	case <-time.After(ShutdownTimeout):
+		left := atomic.LoadInt64(&activeRequests)
+		log.Warn(fmt.Sprintf("shutdown timeout after %s, drained %d requests, %d still active", ShutdownTimeout, active-left, left))
+	}
+	close(done)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/flier/gohs/hyperscan" /* Hyperscan lib */
+	"github.com/valyala/fasthttp"     /* http parse lib */
+	"strings"
+	"unicode/utf8"
+)
+
+/* POST /test request */
+type TestRequest struct {
+	Expr  string  `json:"expr"`
+	Flags string  `json:"flags"` /* --flag when empty */
+	Ext   string  `json:"ext"`
+	Input *string `json:"input"`
+}
+
+/* POST /test result */
+type TestResp struct {
+	Matches  []MatchResp `json:"matches"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+// POST /test, compile expr on its own and scan input with it, for writing rules.
+// The database and scratch are private to the request and freed after it, the
+// loaded rules are never touched.
+func testPatternHandler(ctx *fasthttp.RequestCtx) {
+	var req TestRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: fmt.Sprintf("invalid json: %s", err)})
+		return
+	}
+	if req.Input == nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: "missing field: input"})
+		return
+	}
+	flags, err := parseCompileFlag(Flag)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusInternalServerError, Response{Errno: -2, Msg: err.Error()})
+		return
+	}
+	/* same validation, anchoring and warnings as a rule in a file */
+	id := 0
+	pattern, regexLine, err := newRule("test", ruleSpec{Id: &id, Expr: req.Expr, Flags: req.Flags, Ext: req.Ext}, flags)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: err.Error()})
+		return
+	}
+	input := []byte(*req.Input)
+	if pattern.Flags&hyperscan.Utf8Mode != 0 && !utf8.Valid(input) {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: "input is not valid UTF-8 for a pattern with the u flag"})
+		return
+	}
+
+	matchResps, err := scanOnce(pattern, regexLine, input)
+	if err != nil {
+		writeJSON(ctx, fasthttp.StatusBadRequest, Response{Errno: -1, Msg: err.Error()})
+		return
+	}
+	resp := Response{Errno: 0, Data: TestResp{Matches: matchResps, Warnings: regexLine.Warnings}}
+	if len(matchResps) <= 0 {
+		resp.Errno = 1
+		resp.Msg = "no match"
+	}
+	writeJSON(ctx, fasthttp.StatusOK, resp)
+}
+
+// compile pattern into a throwaway block database and scan input with it
+func scanOnce(pattern *hyperscan.Pattern, regexLine RegexLine, input []byte) ([]MatchResp, error) {
+	patterns := []*hyperscan.Pattern{pattern}
+	db, err := newBlockDatabase(patterns, patternExts(patterns, map[int]RegexLine{pattern.Id: regexLine}))
+	if err != nil {
+		return nil, fmt.Errorf("compile: %s", err)
+	}
+	defer db.Close()
+	scratch, err := hyperscan.NewScratch(db)
+	if err != nil {
+		return nil, fmt.Errorf("alloc scratch: %s", err)
+	}
+	defer scratch.Free()
+
+	som := strings.Contains(regexLine.Flags, "l")
+	matchResps := []MatchResp{}
+	err = db.Scan(input, scratch, func(id uint, from, to uint64, flags uint, context interface{}) error {
+		matchResps = append(matchResps, MatchResp{Id: int(id), From: int(from), To: int(to), Flags: int(flags), Context: snippet(input, from, to, som, ContextWindow), RegexLinev: regexLine, Target: "input", Matched: matchedText(input, from, to)})
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("scan: %s", err)
+	}
+	return sortByOffset(matchResps), nil
+}
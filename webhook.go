@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus" /* structured logger lib */
+	"github.com/valyala/fasthttp"    /* http parse lib */
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	/* matched requests are posted here off the request path, see --webhook-url */
+	webhookQueue    chan WebhookEvent
+	webhookDropped  uint64 /* events dropped because the queue was full */
+	WebhookSeverity string /* lowest severity of a match worth an event, every match when empty */
+)
+
+/* json body posted to --webhook-url */
+type WebhookEvent struct {
+	Time      time.Time      `json:"time"`
+	RequestID string         `json:"request_id"`
+	ClientIP  string         `json:"client_ip"`
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Status    int            `json:"status"`
+	Matches   []WebhookMatch `json:"matches"`
+}
+
+type WebhookMatch struct {
+	Id       int    `json:"id"`
+	Severity string `json:"severity"`
+	Category string `json:"category,omitempty"`
+	Data     string `json:"data"`
+	Target   string `json:"target"`
+	Location string `json:"location"`
+	Matched  string `json:"matched"`
+	Context  string `json:"context"`
+}
+
+// start the worker posting queued events to url, one at a time with timeout each
+func startWebhook(url string, queueSize int, timeout time.Duration) {
+	queue := make(chan WebhookEvent, queueSize)
+	webhookQueue = queue
+	client := &http.Client{Timeout: timeout}
+	go func() {
+		for event := range queue {
+			if err := postWebhook(client, url, event); err != nil {
+				log.Warn(fmt.Sprintf("webhook %s for request %s: %s", url, event.RequestID, err))
+			}
+		}
+	}()
+}
+
+func postWebhook(client *http.Client, url string, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// queue an event for the matches of at least --webhook-severity, never blocks:
+// when the queue is full the event is dropped and counted
+func notifyWebhook(ctx *fasthttp.RequestCtx, status int, matchResps []MatchResp) {
+	if webhookQueue == nil {
+		return
+	}
+	minRank := severityRank(WebhookSeverity)
+	var matches []WebhookMatch
+	for _, m := range matchResps {
+		if severityRank(m.RegexLinev.Severity) < minRank {
+			continue
+		}
+		matches = append(matches, WebhookMatch{
+			Id:       m.Id,
+			Severity: m.RegexLinev.Severity,
+			Category: m.RegexLinev.Category,
+			Data:     m.RegexLinev.Data,
+			Target:   m.Target,
+			Location: m.Location,
+			Matched:  m.Matched,
+			Context:  m.Context,
+		})
+	}
+	if len(matches) <= 0 {
+		return
+	}
+
+	event := WebhookEvent{
+		Time:      time.Now(),
+		RequestID: requestID(ctx),
+		ClientIP:  clientIP(ctx).String(),
+		Method:    string(ctx.Method()),
+		Path:      string(ctx.Path()),
+		Status:    status,
+		Matches:   matches,
+	}
+	select {
+	case webhookQueue <- event:
+	default:
+		if atomic.AddUint64(&webhookDropped, 1)%100 == 1 {
+			log.Warn(fmt.Sprintf("webhook queue full, %d events dropped so far", atomic.LoadUint64(&webhookDropped)))
+		}
+	}
+}
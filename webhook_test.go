@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// test matched requests are posted to the webhook and a full queue drops instead of blocking
+func TestWebhook(t *testing.T) {
+	events := make(chan WebhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	if err := buildScratch("patterns/xss.txt"); err != nil {
+		t.Fatal(err)
+	}
+	ScanTargets = map[string]bool{TargetBody: true}
+	startWebhook(server.URL, 10, time.Second)
+	defer func() { ScanTargets, webhookQueue = nil, nil }()
+
+	doRequest(requestHandler, "/comment", "hello")
+	doRequest(requestHandler, "/comment", "<script>")
+	select {
+	case event := <-events:
+		if event.Path != "/comment" || len(event.Matches) != 1 || event.Matches[0].Id != 101 || event.Matches[0].Matched != "<script>" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook event")
+	}
+
+	/* nobody reads this queue */
+	webhookQueue = make(chan WebhookEvent)
+	dropped := atomic.LoadUint64(&webhookDropped)
+	doRequest(requestHandler, "/comment", "<script>")
+	if n := atomic.LoadUint64(&webhookDropped); n != dropped+1 {
+		t.Errorf("expect a dropped event, got %d", n-dropped)
+	}
+
+	WebhookSeverity = "high"
+	defer func() { WebhookSeverity = "" }()
+	doRequest(requestHandler, "/comment", "<script>")
+	if n := atomic.LoadUint64(&webhookDropped); n != dropped+1 {
+		t.Errorf("expect matches below --webhook-severity to be skipped")
+	}
+}